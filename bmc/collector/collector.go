@@ -2,15 +2,19 @@ package collector
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"sync/atomic"
 	"time"
 
+	"github.com/gebn/bmc_exporter/bmc/sdrcache"
 	"github.com/gebn/bmc_exporter/bmc/subcollector"
 	"github.com/gebn/bmc_exporter/session"
 
+	"github.com/cenkalti/backoff/v4"
 	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
@@ -25,6 +29,20 @@ var (
 		Name:      "collect_duration_seconds",
 		Help:      "Observes the time taken by each BMC collection.",
 	})
+	subcollectorDurations = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "subcollector_duration_seconds",
+		Help: "Observes the time taken by each subcollector's collection " +
+			"across all BMCs, including those that failed.",
+	}, []string{"subcollector"})
+	subcollectorFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "subcollector_failures_total",
+		Help: "The number of times a subcollector failed to collect, " +
+			"usually because the scrape ran out of time.",
+	}, []string{"subcollector"})
 	providerRequests = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
 		Subsystem: subsystem,
@@ -35,9 +53,9 @@ var (
 		Namespace: namespace,
 		Subsystem: subsystem,
 		Name:      "initialise_timeouts_total",
-		Help: "The number of times we established a session, but failed " +
-			"to retrieve the SDR repo and initialise all subcollectors before " +
-			"we timed out.",
+		Help: "The number of times we failed to finish retrieving the SDR " +
+			"repo and initialising all subcollectors in the time available. " +
+			"Initialisation resumes from where it left off next scrape.",
 	})
 	sessionExpiries = promauto.NewCounter(prometheus.CounterOpts{
 		Namespace: namespace,
@@ -52,6 +70,28 @@ var (
 		Help: "The number of collections we ended prematurely to ensure " +
 			"Prometheus received at least some data.",
 	})
+	keepalives = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "keepalives_total",
+		Help: "The number of commands sent to keep an idle session from " +
+			"expiring between scrapes.",
+	})
+	keepaliveFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "keepalive_failures_total",
+		Help: "The number of keepalives that failed, causing the session to " +
+			"be closed.",
+	})
+	backoffSkips = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "backoff_skips_total",
+		Help: "The number of collections that did not attempt to " +
+			"establish a session, because previous attempts failed and the " +
+			"target is backing off.",
+	})
 
 	// "meta" scrape metrics
 	up = prometheus.NewDesc(
@@ -64,6 +104,39 @@ var (
 		"The time taken to collect all metrics, measured by the exporter.",
 		nil, nil,
 	)
+	subcollectorDuration = prometheus.NewDesc(
+		"bmc_subcollector_duration_seconds",
+		"The time taken by the subcollector during this scrape, measured by "+
+			"the exporter.",
+		[]string{"subcollector"}, nil,
+	)
+	subcollectorSuccess = prometheus.NewDesc(
+		"bmc_subcollector_success",
+		"1 if the subcollector collected fresh metrics during this scrape, 0 "+
+			"if it failed or there was no time to run it.",
+		[]string{"subcollector"}, nil,
+	)
+	upReason = prometheus.NewDesc(
+		"bmc_up_reason",
+		"Constant 1 when bmc_up is 0, with a label indicating why: "+
+			"queue_timeout, credentials_missing, authentication_rejected, "+
+			"network_unreachable, session_timeout, sdr_timeout, "+
+			"initialise_timeout or other.",
+		[]string{"reason"}, nil,
+	)
+	initialiseProgress = prometheus.NewDesc(
+		"bmc_initialise_progress_ratio",
+		"The fraction of the SDR repository retrieved and subcollectors "+
+			"initialised with the current session. 1 once the BMC is ready "+
+			"to be scraped.",
+		nil, nil,
+	)
+	sessionBackoff = prometheus.NewDesc(
+		"bmc_session_backoff_seconds",
+		"The time until the exporter will next try to establish a session, "+
+			"following repeated failures. 0 if it is not backing off.",
+		nil, nil,
+	)
 )
 
 // Collector implements the custom collector to scrape metrics from a single BMC
@@ -115,10 +188,56 @@ type Collector struct {
 	// (ba dum tss).
 	Context context.Context
 
+	// InitialBackoff is the time to wait before trying to establish a session
+	// again after the first failure. Subsequent failures double this, with
+	// jitter, up to MaxBackoff. Scrapes during this time return bmc_up 0
+	// without contacting the BMC, avoiding a handshake every scrape with a
+	// BMC that is down or rejecting our credentials, which could lock the
+	// account. Failures to retrieve credentials, and running out of time
+	// waiting for the Limiter, do not cause a backoff, as the BMC was not
+	// contacted. Zero disables backoff.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the time between attempts to establish a session.
+	MaxBackoff time.Duration
+
+	// StaleMaxAge enables serving a subcollector's last successfully collected
+	// metrics if it fails to collect fresh ones, e.g. because the scrape ran
+	// out of time. Metrics older than this are not served. This only applies
+	// while we have a session, so bmc_up remains an accurate indication of
+	// whether the BMC is reachable. Zero disables the feature.
+	StaleMaxAge time.Duration
+
+	// Limiter is shared between all collectors, and bounds how many can be
+	// establishing a session and walking the SDR repository at once. Nil
+	// means no limit.
+	Limiter *Limiter
+
+	// SDRCache is shared between all collectors, and avoids retrieving the
+	// SDR repository each time a session is established if it has not
+	// changed. Nil means the repository is always retrieved.
+	SDRCache *sdrcache.Cache
+
+	// Thresholds enables exposing the thresholds of threshold-based sensors
+	// from their Full Sensor Records, alongside their readings.
+	Thresholds bool
+
+	// SensorDump, if non-nil, exposes every threshold-based sensor without
+	// normalisation, in addition to the other subcollectors. It must not be
+	// shared between collectors.
+	SensorDump *subcollector.SensorDump
+
 	bmcInfo               subcollector.BMCInfo
 	chassisStatus         subcollector.ChassisStatus
 	processorTemperatures subcollector.ProcessorTemperatures
 	powerDraw             subcollector.PowerDraw
+	chassisTemperatures   subcollector.ChassisTemperatures
+	fanSpeeds             subcollector.FanSpeeds
+	voltages              subcollector.Voltages
+
+	// getSessionInfo is the request sent as a keepalive. It asks about the
+	// current session, which needs no further fields set.
+	getSessionInfo ipmi.GetSessionInfoReq
 
 	// session is the session we've established with the target addr, if any.
 	// This will be nil if no collection has been attempted, or if
@@ -130,6 +249,41 @@ type Collector struct {
 	// is operating over. We close this before trying to establish a new
 	// session.
 	closer io.Closer
+
+	// backoff produces the delays between attempts to establish a session. It
+	// is nil until the first failure.
+	backoff *backoff.ExponentialBackOff
+
+	// retryAt is when we will next attempt to establish a session. It is
+	// zero if we are not backing off.
+	retryAt time.Time
+
+	// reason explains why the last attempt to establish a session failed. It
+	// is retained while backing off, so bmc_up_reason remains accurate.
+	reason string
+
+	// initialising is true if we have a session, but have not yet finished
+	// retrieving the SDR repository and initialising subcollectors. The
+	// session is kept, so the next scrape can continue where this one left
+	// off rather than starting again.
+	initialising bool
+
+	// walker retrieves the SDR repository over as many scrapes as necessary.
+	// Its progress survives the session being re-established.
+	walker sdrWalker
+
+	// sdrr is the retrieved SDR repository, retained until all subcollectors
+	// have been initialised with it.
+	sdrr bmc.SDRRepository
+
+	// initialised is the number of subcollectors that have been initialised
+	// with the current session. It is reset when the session is closed.
+	initialised int
+
+	// stale contains the last metrics successfully collected by each
+	// subcollector, keyed by name. It is only populated if StaleMaxAge is
+	// non-zero.
+	stale map[string]staleMetrics
 }
 
 // LastCollection returns when this collector was last invoked as nanoseconds
@@ -147,7 +301,15 @@ func (c *Collector) LastCollection() int64 {
 func (c *Collector) Describe(d chan<- *prometheus.Desc) {
 	// descriptors are all pre-allocated; we simply send them
 	d <- up
+	d <- upReason
 	d <- scrapeDuration
+	d <- initialiseProgress
+	d <- sessionBackoff
+	d <- subcollectorDuration
+	d <- subcollectorSuccess
+	if c.StaleMaxAge > 0 {
+		d <- metricAge
+	}
 
 	// ask each subcollector to describe itself; this is partly why these
 	// objects have the same lifetime as this collector (the other reason being
@@ -156,6 +318,12 @@ func (c *Collector) Describe(d chan<- *prometheus.Desc) {
 	c.chassisStatus.Describe(d)
 	c.processorTemperatures.Describe(d)
 	c.powerDraw.Describe(d)
+	c.chassisTemperatures.Describe(d)
+	c.fanSpeeds.Describe(d)
+	c.voltages.Describe(d)
+	if c.SensorDump != nil {
+		c.SensorDump.Describe(d)
+	}
 }
 
 // Collect sends a number of commands to the BMC to gather metrics about its
@@ -193,10 +361,17 @@ func (c *Collector) collect(ctx context.Context, ch chan<- prometheus.Metric) er
 	// N.B. once a session is established, we assume it will not be invalidated
 	// in the same scrape. If this is invalid, we have problems - restarting a
 	// session involves potentially hundreds of commands to enumerate the SDR.
-	if c.session == nil {
-		// first scrape, target GCd since last scrape
+	if c.session == nil || c.initialising {
+		if c.session == nil && time.Until(c.retryAt) > 0 {
+			// recent attempts failed; don't bother the BMC
+			backoffSkips.Inc()
+			c.collectDown(ch)
+			return nil
+		}
+		// first scrape, target GCd since last scrape, or the last scrape
+		// did not have time to finish initialising
 		if err := c.newSession(ctx); err != nil {
-			ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0)
+			c.collectDown(ch)
 			return fmt.Errorf("could not obtain session for %v: %v", c.Target, err)
 		}
 		if err := c.bmcInfo.Collect(ctx, ch); err != nil {
@@ -223,8 +398,9 @@ func (c *Collector) collect(ctx context.Context, ch chan<- prometheus.Metric) er
 			defer closeCancel()
 			c.Close(closeCtx)
 			if err := c.newSession(ctx); err != nil {
-				// give up; newSession() ensures we're left in a clean state
-				ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0)
+				// give up; newSession() ensures we're left in a state where
+				// the next scrape can try again, or continue initialising
+				c.collectDown(ch)
 				return fmt.Errorf("could not obtain session for %v: %v", c.Target, err)
 			}
 			// retry as normal
@@ -235,69 +411,311 @@ func (c *Collector) collect(ctx context.Context, ch chan<- prometheus.Metric) er
 	}
 	// we could establish a session: BMC is healthy
 	ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 1)
+	c.collectProgress(ch)
+	c.collectBackoff(ch)
 
 	// TODO probably should be two different methods...?
 
-	// let each subcollector do its thing. We break on error as the only reason
-	// for an error is ctx expiry, in which case there is no time to send any
-	// more commands so we return what we have. This could be done in parallel,
-	// however very little computation is done - it's really just sending
-	// commands, which have to be serialised anyway, so there would be little
-	// gain.
-	if err := c.chassisStatus.Collect(ctx, ch); err != nil {
-		return err
+	// let each subcollector do its thing. We stop collecting on error as the
+	// only reason for an error is ctx expiry, in which case there is no time
+	// to send any more commands so we return what we have, topped up with
+	// stale metrics if enabled. This could be done in parallel, however very
+	// little computation is done - it's really just sending commands, which
+	// have to be serialised anyway, so there would be little gain. New
+	// subcollectors go at the end, so they cannot cause existing metrics to
+	// be dropped from scrapes that run out of time.
+	subcollectors := []namedSubcollector{
+		{&c.chassisStatus, "chassis_status"},
+		{&c.processorTemperatures, "processor_temperatures"},
+		{&c.powerDraw, "power_draw"},
+		{&c.chassisTemperatures, "chassis_temperatures"},
+		{&c.fanSpeeds, "fan_speeds"},
+		{&c.voltages, "voltages"},
 	}
-	if err := c.processorTemperatures.Collect(ctx, ch); err != nil {
-		return err
+	if c.SensorDump != nil {
+		// last, as it is the least valuable, and potentially the slowest
+		subcollectors = append(subcollectors,
+			namedSubcollector{c.SensorDump, "sensor_dump"})
+	}
+	var err error
+	for _, s := range subcollectors {
+		if err != nil {
+			ch <- prometheus.MustNewConstMetric(subcollectorSuccess,
+				prometheus.GaugeValue, 0, s.name)
+			if c.StaleMaxAge > 0 {
+				c.serveStale(s.name, ch)
+			}
+			continue
+		}
+		err = c.collectSubcollector(ctx, s, ch)
+	}
+	return err
+}
+
+// collectSubcollector collects a single subcollector, reporting how long it
+// took and whether it succeeded.
+func (c *Collector) collectSubcollector(ctx context.Context, s namedSubcollector, ch chan<- prometheus.Metric) error {
+	start := time.Now()
+	err := c.collectOrServeStale(ctx, s, ch)
+	elapsed := time.Since(start)
+	subcollectorDurations.WithLabelValues(s.name).Observe(elapsed.Seconds())
+	ch <- prometheus.MustNewConstMetric(subcollectorDuration,
+		prometheus.GaugeValue, elapsed.Seconds(), s.name)
+	success := 1.
+	if err != nil {
+		subcollectorFailures.WithLabelValues(s.name).Inc()
+		success = 0
 	}
-	if err := c.powerDraw.Collect(ctx, ch); err != nil {
+	ch <- prometheus.MustNewConstMetric(subcollectorSuccess,
+		prometheus.GaugeValue, success, s.name)
+	return err
+}
+
+// collectOrServeStale collects a single subcollector. If StaleMaxAge is
+// non-zero, its metrics are retained if collection succeeds, and the previous
+// ones served if it does not.
+func (c *Collector) collectOrServeStale(ctx context.Context, s namedSubcollector, ch chan<- prometheus.Metric) error {
+	if c.StaleMaxAge == 0 {
+		return s.Collect(ctx, ch)
+	}
+	metrics, err := buffer(func(ch chan<- prometheus.Metric) error {
+		return s.Collect(ctx, ch)
+	})
+	if err != nil {
+		if !c.serveStale(s.name, ch) {
+			// better than nothing
+			for _, m := range metrics {
+				ch <- m
+			}
+		}
 		return err
 	}
+	if c.stale == nil {
+		c.stale = map[string]staleMetrics{}
+	}
+	c.stale[s.name] = staleMetrics{
+		metrics:   metrics,
+		collected: time.Now(),
+	}
+	for _, m := range metrics {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(metricAge, prometheus.GaugeValue, 0,
+		s.name)
 	return nil
 }
 
-// newSession establishes a session with a BMC, and performs discovery to
-// relieve subsequent scrapes of doing this. This method does not close any
-// existing session. It is not necessary to call Close() if it returns a non-nil
-// error.
+// newSession establishes a session with a BMC if we do not have one, and
+// performs discovery to relieve subsequent scrapes of doing this. If discovery
+// does not finish in time, the session is retained, and the next call
+// continues from where this one left off. This method does not close any
+// existing session. It is not necessary to call Close() if it returns a
+// non-nil error.
 func (c *Collector) newSession(ctx context.Context) error {
 	// general point: if there's one thing to be *really* careful of, it's
 	// partially initialised sessions. We have to ensure everything is
-	// initialised successfully, or the collector is left in a clean state for a
-	// retry next time, otherwise we end up trying to invoke methods on a nil
-	// session which doesn't end well.
-
-	providerRequests.Inc() // TODO should be moved to provider itself?
-	session, closer, err := c.Provider.Session(ctx, c.Target)
-	// setting these here in the error case avoids repeatedly trying to close,
-	// preventing a negative number of open sessions/connections
-	c.session = session
-	c.closer = closer
-	if err != nil {
-		// provider interface guarantees c.session and c.closer are now nil
+	// initialised successfully before the session is used for collection, or
+	// the collector is left in a clean state for a retry next time, otherwise
+	// we end up trying to invoke methods on a nil session which doesn't end
+	// well.
+
+	if err := c.Limiter.Acquire(ctx); err != nil {
+		// the BMC was not contacted, so this is no reason to back off
+		c.reason = reasonQueueTimeout
 		return err
 	}
+	defer c.Limiter.Release()
 
-	sdrr, err := bmc.RetrieveSDRRepository(ctx, session)
-	if err != nil {
-		c.Close(ctx) // otherwise collector is left partially initialised
+	if c.session == nil {
+		providerRequests.Inc() // TODO should be moved to provider itself?
+		sess, closer, err := c.Provider.Session(ctx, c.Target)
+		// setting these here in the error case avoids repeatedly trying to
+		// close, preventing a negative number of open sessions/connections
+		c.session = sess
+		c.closer = closer
+		if err != nil {
+			// provider interface guarantees c.session and c.closer are now nil
+			c.reason = classify(stageSession, err)
+			switch c.reason {
+			case reasonAuthenticationRejected, reasonNetworkUnreachable:
+				c.backOff()
+			case reasonSessionTimeout:
+				// we had credentials and a slot, so the BMC was silent, e.g.
+				// because it is powered off; a timeout retrieving credentials
+				// is the secrets store's problem, and no reason to wait
+				if session.IsHandshakeFailure(err) &&
+					!errors.Is(err, context.Canceled) {
+					c.backOff()
+				}
+			}
+			return err
+		}
+		// failures after this point are slow BMCs rather than dead ones, and
+		// backing off would only delay initialisation further
+		c.ResetBackoff()
+		c.initialising = true
+	}
+	return c.initialise(ctx)
+}
+
+// initialise continues retrieving the SDR repository and initialising
+// subcollectors with the current session. If it runs out of time, the session
+// is kept so the next call can resume, unless no progress at all was made, in
+// which case the session has likely expired, and is closed so the next scrape
+// establishes a new one. Retrieved SDRs are kept either way.
+func (c *Collector) initialise(ctx context.Context) error {
+	before, _ := c.progress()
+	if err := c.continueInitialise(ctx); err != nil {
 		initialiseTimeouts.Inc()
+		if after, _ := c.progress(); after == before {
+			c.Close(ctx)
+		}
 		return err
 	}
+	c.initialising = false
+	c.sdrr = nil // subcollectors have taken what they need
+	return nil
+}
+
+// continueInitialise does the work of initialise().
+func (c *Collector) continueInitialise(ctx context.Context) error {
+	if c.sdrr == nil {
+		sdrr, err := c.SDRCache.Retrieve(ctx, c.session, c.walker.walk)
+		if err != nil {
+			c.reason = classify(stageSDR, err)
+			return err
+		}
+		c.sdrr = sdrr
+	}
+	subcollectors := c.subcollectors()
+	for ; c.initialised < len(subcollectors); c.initialised++ {
+		s := subcollectors[c.initialised]
+		if t, ok := s.(thresholdSubcollector); ok {
+			t.EnableThresholds(c.Thresholds)
+		}
+		err := s.Initialise(ctx, c.session, c.sdrr)
+		if err != nil {
+			c.reason = classify(stageInitialise, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// progress returns the number of initialisation steps completed with the
+// current session, and the total number of steps. Each SDR and subcollector is
+// a step. The total is only an estimate until SDR retrieval begins, as it
+// depends on the number of records in the repository.
+func (c *Collector) progress() (int, int) {
+	if c.session != nil && !c.initialising {
+		return 1, 1
+	}
+	retrieved, records := c.walker.progress()
+	if c.sdrr != nil {
+		// the walker is reset once it finishes, and will not have started if
+		// the repository was cached
+		retrieved, records = len(c.sdrr), len(c.sdrr)
+	}
+	return retrieved + c.initialised, records + len(c.subcollectors())
+}
+
+// subcollectors returns the subcollectors in the order they are initialised.
+func (c *Collector) subcollectors() []Subcollector {
 	subcollectors := []Subcollector{
 		&c.chassisStatus,
 		&c.bmcInfo,
 		&c.processorTemperatures,
 		&c.powerDraw,
+		&c.chassisTemperatures,
+		&c.fanSpeeds,
+		&c.voltages,
 	}
-	for _, subcollector := range subcollectors {
-		if err := subcollector.Initialise(ctx, session, sdrr); err != nil {
-			c.Close(ctx)
-			initialiseTimeouts.Inc()
-			return err
-		}
+	if c.SensorDump != nil {
+		subcollectors = append(subcollectors, c.SensorDump)
 	}
-	return nil
+	return subcollectors
+}
+
+// backOff schedules the next attempt to establish a session, following a
+// failure. It does nothing if backoff is disabled.
+func (c *Collector) backOff() {
+	if c.InitialBackoff == 0 {
+		return
+	}
+	if c.backoff == nil {
+		c.backoff = backoff.NewExponentialBackOff()
+		c.backoff.InitialInterval = c.InitialBackoff
+		c.backoff.MaxInterval = c.MaxBackoff
+		c.backoff.MaxElapsedTime = 0 // never give up
+		c.backoff.Reset()
+	}
+	c.retryAt = time.Now().Add(c.backoff.NextBackOff())
+}
+
+// ResetBackoff allows the next collection to try to establish a session
+// immediately, regardless of previous failures. This is called when a session
+// is established, and when the target's credentials change, as the new ones
+// may work.
+func (c *Collector) ResetBackoff() {
+	c.retryAt = time.Time{}
+	if c.backoff != nil {
+		c.backoff.Reset()
+	}
+}
+
+// collectDown sends the metrics for a target we do not have an initialised
+// session with.
+func (c *Collector) collectDown(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(up, prometheus.GaugeValue, 0)
+	ch <- prometheus.MustNewConstMetric(upReason, prometheus.GaugeValue, 1,
+		c.reason)
+	c.collectProgress(ch)
+	c.collectBackoff(ch)
+}
+
+// collectProgress sends how far through initialisation we are.
+func (c *Collector) collectProgress(ch chan<- prometheus.Metric) {
+	done, total := c.progress()
+	ch <- prometheus.MustNewConstMetric(
+		initialiseProgress,
+		prometheus.GaugeValue,
+		float64(done)/float64(total),
+	)
+}
+
+// collectBackoff sends the time remaining until the next attempt to establish
+// a session.
+func (c *Collector) collectBackoff(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(
+		sessionBackoff,
+		prometheus.GaugeValue,
+		max(time.Until(c.retryAt), 0).Seconds(),
+	)
+}
+
+// Keepalive sends a cheap command over the session, if it has been
+// initialised, to prevent the BMC expiring it while idle. This allows the
+// session to outlive the BMC's session timeout, which the specification
+// recommends be 60s, when the scrape interval is longer. If the command fails,
+// the session is assumed to have already expired, and is closed, so the next
+// scrape establishes a new one without waiting for the canary to time out.
+func (c *Collector) Keepalive(ctx context.Context) {
+	if c.session == nil || c.initialising {
+		return
+	}
+	keepalives.Inc()
+	if _, err := c.session.GetSessionInfo(ctx, &c.getSessionInfo); err != nil {
+		keepaliveFailures.Inc()
+		sessionExpiries.Inc()
+		c.Close(ctx)
+	}
+}
+
+// HasSession returns whether the collector has a session with the BMC, which
+// may have expired. Like Close(), it must not be called concurrently with
+// collection.
+func (c *Collector) HasSession() bool {
+	return c.session != nil
 }
 
 // Close cleanly terminates the underlying BMC connection and socket that powers
@@ -319,4 +737,8 @@ func (c *Collector) Close(ctx context.Context) {
 
 	c.session = nil
 	c.closer = nil
+	// subcollectors must be initialised with the next session; any SDRs
+	// retrieved so far are still valid, but our reservation is not
+	c.initialised = 0
+	c.walker.sessionClosed()
 }
@@ -0,0 +1,181 @@
+package collector
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	limiterQueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "session_queue_depth",
+		Help: "The number of collectors waiting for permission to " +
+			"establish a session and walk the SDR repository.",
+	})
+	limiterInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "session_slots_in_use",
+		Help: "The number of collectors currently establishing a session " +
+			"or walking the SDR repository.",
+	})
+	limiterWait = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "session_queue_wait_seconds",
+		Help: "Observes the time collectors spent waiting for permission " +
+			"to establish a session, including those that gave up.",
+		Buckets: []float64{.001, .01, .1, .5, 1, 2, 4, 8, 16},
+	})
+)
+
+// Limiter bounds the number of collectors establishing a session and walking
+// the SDR repository at once, across all targets. Without it, an exporter
+// restart causes every target to do this at the same time, saturating the
+// exporter and management network. Waiters are admitted earliest deadline
+// first, so scrapes closest to timing out get the next slot; waiters without a
+// deadline go last. A nil *Limiter imposes no limit.
+type Limiter struct {
+	mu      sync.Mutex
+	limit   int
+	inUse   int
+	waiters waiterHeap
+
+	// seq breaks ties between waiters with the same deadline, so they are
+	// admitted in the order they arrived.
+	seq uint64
+}
+
+// NewLimiter creates a limiter allowing up to n concurrent holders. n must be
+// positive.
+func NewLimiter(n int) *Limiter {
+	return &Limiter{
+		limit: n,
+	}
+}
+
+// Acquire blocks until a slot is available or the context expires, in which
+// case the context's error is returned. Release() must be called if and only
+// if the returned error is nil.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+	start := time.Now()
+	defer func() {
+		limiterWait.Observe(time.Since(start).Seconds())
+	}()
+
+	l.mu.Lock()
+	if l.inUse < l.limit && len(l.waiters) == 0 {
+		l.inUse++
+		limiterInUse.Inc()
+		l.mu.Unlock()
+		return nil
+	}
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Unix(0, math.MaxInt64)
+	}
+	w := &waiter{
+		deadline: deadline,
+		seq:      l.seq,
+		ready:    make(chan struct{}),
+	}
+	l.seq++
+	heap.Push(&l.waiters, w)
+	limiterQueueDepth.Inc()
+	l.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		if w.index < 0 {
+			// granted a slot at the same time as giving up; pass it on
+			l.mu.Unlock()
+			l.Release()
+		} else {
+			heap.Remove(&l.waiters, w.index)
+			limiterQueueDepth.Dec()
+			l.mu.Unlock()
+		}
+		return ctx.Err()
+	}
+}
+
+// Release returns a slot obtained by Acquire(), handing it to the waiter with
+// the earliest deadline, if any.
+func (l *Limiter) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiters) == 0 {
+		l.inUse--
+		limiterInUse.Dec()
+		return
+	}
+	// the slot passes directly to the waiter, so inUse is unchanged
+	w := heap.Pop(&l.waiters).(*waiter)
+	limiterQueueDepth.Dec()
+	close(w.ready)
+}
+
+// waiter is a collector queueing in Acquire().
+type waiter struct {
+	deadline time.Time
+	seq      uint64
+
+	// ready is closed when the waiter has been given a slot.
+	ready chan struct{}
+
+	// index is the waiter's position in the heap, or -1 once it has been
+	// removed.
+	index int
+}
+
+// waiterHeap implements heap.Interface, ordering waiters by deadline.
+type waiterHeap []*waiter
+
+func (h waiterHeap) Len() int {
+	return len(h)
+}
+
+func (h waiterHeap) Less(i, j int) bool {
+	if !h[i].deadline.Equal(h[j].deadline) {
+		return h[i].deadline.Before(h[j].deadline)
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h waiterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *waiterHeap) Push(x interface{}) {
+	w := x.(*waiter)
+	w.index = len(*h)
+	*h = append(*h, w)
+}
+
+func (h *waiterHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	w := old[n-1]
+	old[n-1] = nil
+	w.index = -1
+	*h = old[:n-1]
+	return w
+}
@@ -0,0 +1,77 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/gebn/bmc_exporter/session"
+)
+
+// Reasons for bmc_up being 0, exposed in the bmc_up_reason metric. Each
+// failure is attributed to the first stage of initialisation that did not
+// complete.
+const (
+	reasonQueueTimeout           = "queue_timeout"
+	reasonCredentialsMissing     = "credentials_missing"
+	reasonAuthenticationRejected = "authentication_rejected"
+	reasonNetworkUnreachable     = "network_unreachable"
+	reasonSessionTimeout         = "session_timeout"
+	reasonSDRTimeout             = "sdr_timeout"
+	reasonInitialiseTimeout      = "initialise_timeout"
+	reasonOther                  = "other"
+)
+
+// stage identifies the part of newSession() that failed.
+type stage int
+
+const (
+	stageSession stage = iota
+	stageSDR
+	stageInitialise
+)
+
+// classify returns the reason for an error that occurred during a given stage
+// of establishing a session.
+func classify(s stage, err error) string {
+	switch {
+	case errors.Is(err, session.ErrCredentialNotFound):
+		return reasonCredentialsMissing
+	case session.IsAuthenticationFailure(err):
+		return reasonAuthenticationRejected
+	case isUnreachable(err):
+		return reasonNetworkUnreachable
+	case isTimeout(err):
+		switch s {
+		case stageSession:
+			return reasonSessionTimeout
+		case stageSDR:
+			return reasonSDRTimeout
+		default:
+			return reasonInitialiseTimeout
+		}
+	default:
+		return reasonOther
+	}
+}
+
+// isUnreachable returns whether an error indicates the BMC cannot be reached at
+// all, as opposed to not responding in time. For UDP, a refused connection
+// means an ICMP port unreachable was received.
+func isUnreachable(err error) bool {
+	dnsErr := &net.DNSError{}
+	return errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.EHOSTDOWN) ||
+		errors.As(err, &dnsErr)
+}
+
+// isTimeout returns whether an error was caused by running out of time.
+func isTimeout(err error) bool {
+	netErr := net.Error(nil)
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, context.Canceled) ||
+		(errors.As(err, &netErr) && netErr.Timeout())
+}
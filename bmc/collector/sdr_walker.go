@@ -0,0 +1,187 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+	"github.com/google/gopacket"
+)
+
+const (
+	sdrHeaderLength = 5
+	sdrMaxLength    = 64
+)
+
+// sdrWalker retrieves the SDR repository, picking up where it left off if
+// interrupted. This is what allows a BMC too slow to be fully initialised in a
+// single scrape to become scrapeable over several. bmc.RetrieveSDRRepository()
+// starts from the beginning each time, so cannot be used.
+//
+// The retrieved records outlive the session, as they belong to the BMC rather
+// than our connection to it. The repository info obtained when the walk began
+// is compared with that at the end, and the walk restarted if a record was
+// added or erased in the meantime, which could have invalidated records
+// retrieved earlier. The zero value is ready to use.
+type sdrWalker struct {
+
+	// info is the repository info obtained at the start of the current walk.
+	// It is nil if no walk is in progress.
+	info *ipmi.GetSDRRepositoryInfoRsp
+
+	// repo contains the Full Sensor Records retrieved so far.
+	repo bmc.SDRRepository
+
+	// retrieved is the number of records of any type retrieved so far.
+	retrieved int
+
+	// reservedWith is the session that obtained the reservation ID in cmd,
+	// or nil if we have no reservation. Reservations do not survive a new
+	// session, so we reserve again if it differs from the session we are
+	// given. It is cleared by sessionClosed(), so a closed session is not
+	// kept alive until the next walk.
+	reservedWith bmc.Session
+
+	// cmd is the command used to retrieve each record. Its RecordID is the
+	// next record to retrieve.
+	cmd ipmi.GetSDRCmd
+}
+
+// walk continues the current walk, or starts a new one, returning the complete
+// repository if it reaches the end. If an error is returned, the next call
+// continues from the record that could not be retrieved. The signature
+// matches that expected by sdrcache.Cache.
+func (w *sdrWalker) walk(ctx context.Context, s bmc.Session) (bmc.SDRRepository, error) {
+	for {
+		if w.info == nil {
+			info, err := s.GetSDRRepositoryInfo(ctx)
+			if err != nil {
+				return nil, err
+			}
+			w.info = info
+			w.repo = bmc.SDRRepository{}
+			w.retrieved = 0
+			w.cmd.Req.RecordID = ipmi.RecordIDFirst
+		}
+
+		// it's ambiguous whether we retrieve ipmi.RecordIDLast; as with the
+		// bmc library, we don't, as it duplicates the final record
+		for w.cmd.Req.RecordID != ipmi.RecordIDLast {
+			if err := w.step(ctx, s); err != nil {
+				return nil, err
+			}
+		}
+
+		info, err := s.GetSDRRepositoryInfo(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if w.info.LastAddition.Before(info.LastAddition) ||
+			w.info.LastErase.Before(info.LastErase) {
+			// tough luck, start again
+			w.info = nil
+			continue
+		}
+		repo := w.repo
+		w.reset()
+		return repo, nil
+	}
+}
+
+// step retrieves the next record, reserving the repository first if
+// necessary. Records other than Full Sensor Records are skipped after reading
+// their header.
+func (w *sdrWalker) step(ctx context.Context, s bmc.Session) error {
+	if w.reservedWith != s {
+		if err := w.reserve(ctx, s); err != nil {
+			return err
+		}
+	}
+
+	w.cmd.Req.Offset = 0
+	w.cmd.Req.Length = sdrHeaderLength
+	if err := w.send(ctx, s); err != nil {
+		return err
+	}
+	headerPacket := gopacket.NewPacket(w.cmd.Rsp.Payload, ipmi.LayerTypeSDR,
+		gopacket.DecodeOptions{Lazy: true})
+	headerLayer := headerPacket.Layer(ipmi.LayerTypeSDR)
+	if headerLayer == nil {
+		return fmt.Errorf("packet is missing SDR layer: %v", &w.cmd)
+	}
+	header := headerLayer.(*ipmi.SDR)
+
+	if header.Type == ipmi.RecordTypeFullSensor {
+		if header.Length > sdrMaxLength {
+			return fmt.Errorf("SDR length %d exceeds max of %d bytes: %v",
+				header.Length, sdrMaxLength, &w.cmd)
+		}
+		w.cmd.Req.Offset = sdrHeaderLength
+		w.cmd.Req.Length = header.Length
+		if err := w.send(ctx, s); err != nil {
+			return err
+		}
+		fsrPacket := gopacket.NewPacket(w.cmd.Rsp.Payload,
+			ipmi.LayerTypeFullSensorRecord, gopacket.DecodeOptions{Lazy: true})
+		fsrLayer := fsrPacket.Layer(ipmi.LayerTypeFullSensorRecord)
+		if fsrLayer == nil {
+			return fmt.Errorf("packet is missing Full Sensor Record layer: %v",
+				&w.cmd)
+		}
+		w.repo[w.cmd.Req.RecordID] = fsrLayer.(*ipmi.FullSensorRecord)
+	}
+
+	w.retrieved++
+	w.cmd.Req.RecordID = w.cmd.Rsp.Next
+	return nil
+}
+
+// send sends the Get SDR command, reserving the repository and retrying once
+// if the BMC says our reservation is no longer valid. This happens when
+// another requester, such as the other exporter in a pair, reserves the
+// repository between our commands.
+func (w *sdrWalker) send(ctx context.Context, s bmc.Session) error {
+	code, err := s.SendCommand(ctx, &w.cmd)
+	if err == nil && code == ipmi.CompletionCodeReservationCanceledOrInvalid {
+		if err := w.reserve(ctx, s); err != nil {
+			return err
+		}
+		code, err = s.SendCommand(ctx, &w.cmd)
+	}
+	return bmc.ValidateResponse(code, err)
+}
+
+// reserve obtains a new reservation ID, which is needed for partial reads.
+func (w *sdrWalker) reserve(ctx context.Context, s bmc.Session) error {
+	rsp, err := s.ReserveSDRRepository(ctx)
+	if err != nil {
+		return err
+	}
+	w.cmd.Req.ReservationID = rsp.ReservationID
+	w.reservedWith = s
+	return nil
+}
+
+// sessionClosed drops our reference to the session that obtained the current
+// reservation, which is no longer valid. Any walk in progress continues with
+// the next session.
+func (w *sdrWalker) sessionClosed() {
+	w.reservedWith = nil
+}
+
+// progress returns the number of records retrieved so far in the current walk,
+// and the number of records in the repository when it began. Both are zero if
+// no walk is in progress.
+func (w *sdrWalker) progress() (int, int) {
+	if w.info == nil {
+		return 0, 0
+	}
+	return w.retrieved, int(w.info.Records)
+}
+
+// reset abandons any walk in progress, so the next walk starts from the
+// beginning.
+func (w *sdrWalker) reset() {
+	*w = sdrWalker{}
+}
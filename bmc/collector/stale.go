@@ -0,0 +1,80 @@
+package collector
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	staleCollections = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "stale_collections_total",
+		Help: "The number of times a subcollector's last successfully " +
+			"collected metrics were served in place of fresh ones.",
+	})
+
+	metricAge = prometheus.NewDesc(
+		"bmc_metric_age_seconds",
+		"The time since the subcollector's metrics were obtained from the "+
+			"BMC. Non-zero if they could not be refreshed in time, and the "+
+			"last successfully collected values were served instead.",
+		[]string{"subcollector"}, nil,
+	)
+)
+
+// namedSubcollector associates a subcollector with the name used to identify
+// it in metrics.
+type namedSubcollector struct {
+	Subcollector
+	name string
+}
+
+// staleMetrics is the last complete set of metrics collected by a
+// subcollector. Const metrics are immutable, so can be sent again.
+type staleMetrics struct {
+	metrics   []prometheus.Metric
+	collected time.Time
+}
+
+// buffer collects a subcollector's metrics into a slice rather than sending
+// them to the scrape, so they can be retained, and discarded if the collection
+// does not complete.
+func buffer(collect func(chan<- prometheus.Metric) error) ([]prometheus.Metric, error) {
+	ch := make(chan prometheus.Metric)
+	done := make(chan []prometheus.Metric)
+	go func() {
+		metrics := []prometheus.Metric{}
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		done <- metrics
+	}()
+	err := collect(ch)
+	close(ch)
+	return <-done, err
+}
+
+// serveStale sends the last successfully collected metrics for a subcollector
+// in place of fresh ones, along with their age. It returns false without
+// sending anything if there are none, or they are older than StaleMaxAge.
+func (c *Collector) serveStale(name string, ch chan<- prometheus.Metric) bool {
+	stale, ok := c.stale[name]
+	if !ok {
+		return false
+	}
+	age := time.Since(stale.collected)
+	if age > c.StaleMaxAge {
+		delete(c.stale, name)
+		return false
+	}
+	staleCollections.Inc()
+	for _, m := range stale.metrics {
+		ch <- m
+	}
+	ch <- prometheus.MustNewConstMetric(metricAge, prometheus.GaugeValue,
+		age.Seconds(), name)
+	return true
+}
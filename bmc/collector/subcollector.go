@@ -64,3 +64,10 @@ type Subcollector interface {
 	// I haven't implemented a subcollector with any state needing explicit
 	// Close()ing, so this interface lacks that method.
 }
+
+// thresholdSubcollector is implemented by subcollectors of threshold-based
+// sensors, which can optionally expose those sensors' thresholds. This is
+// satisfied by embedding subcollector.Thresholds.
+type thresholdSubcollector interface {
+	EnableThresholds(bool)
+}
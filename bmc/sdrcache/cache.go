@@ -0,0 +1,269 @@
+// Package sdrcache avoids retrieving a BMC's SDR repository every time a
+// session is established. Retrieval involves at least two commands per sensor,
+// so can run to hundreds of round trips, and is the main reason slow BMCs fail
+// to initialise in time.
+//
+// Repositories are keyed by the BMC's system GUID rather than its address, so
+// an entry follows the BMC if its address changes, and is not reused if the
+// address is reassigned to a different machine. An entry is used only if the
+// BMC's SDR repository has not had a record added or erased since it was
+// retrieved. BMCs with a GUID of all 0x00 or 0xff bytes, which some use to
+// mean "unset", are never cached, as the GUID is unlikely to be unique.
+package sdrcache
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+	"github.com/google/gopacket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	namespace = "bmc"
+	subsystem = "sdr_cache"
+
+	hits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "hits_total",
+		Help: "The number of times a cached SDR repository was used " +
+			"instead of retrieving it from the BMC.",
+	})
+	misses = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "misses_total",
+		Help: "The number of attempts to retrieve the SDR repository from " +
+			"the BMC, because it was not cached, had changed, or the BMC's " +
+			"GUID could not be used. A retrieval spread across several " +
+			"scrapes counts once per scrape.",
+	})
+	entries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "entries",
+		Help:      "The number of SDR repositories held in memory.",
+	})
+)
+
+// entry is a cached SDR repository. It is also the on-disk format.
+type entry struct {
+
+	// LastAddition and LastErase are the timestamps returned by Get SDR
+	// Repository Info before the repository was retrieved. If either has
+	// changed, the entry is stale.
+	LastAddition time.Time `json:"last_addition"`
+	LastErase    time.Time `json:"last_erase"`
+
+	// Records contains the raw record key and body bytes of each Full Sensor
+	// Record. We store these rather than the decoded records, as the ipmi
+	// package's types are not designed to be serialised, and decoding is
+	// cheap compared to retrieval.
+	Records map[ipmi.RecordID][]byte `json:"records"`
+}
+
+// valid returns whether the entry reflects a repository with the supplied
+// info.
+func (e *entry) valid(info *ipmi.GetSDRRepositoryInfoRsp) bool {
+	return e.LastAddition.Equal(info.LastAddition) &&
+		e.LastErase.Equal(info.LastErase)
+}
+
+// repository decodes the entry's records.
+func (e *entry) repository() (bmc.SDRRepository, error) {
+	repo := make(bmc.SDRRepository, len(e.Records))
+	for id, b := range e.Records {
+		fsr := &ipmi.FullSensorRecord{}
+		if err := fsr.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+			return nil, fmt.Errorf("record %v: %w", id, err)
+		}
+		repo[id] = fsr
+	}
+	return repo, nil
+}
+
+// Cache stores SDR repositories in memory, and optionally a directory so they
+// survive restarts. It is safe for concurrent use. A nil *Cache does not cache
+// anything.
+type Cache struct {
+	dir string
+
+	mu      sync.Mutex
+	entries map[[16]byte]*entry
+}
+
+// New creates a cache. If dir is non-empty, entries are also written to files
+// in that directory, which is created if it does not exist, and read back if
+// they are not in memory.
+func New(dir string) (*Cache, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, err
+		}
+	}
+	return &Cache{
+		dir:     dir,
+		entries: map[[16]byte]*entry{},
+	}, nil
+}
+
+// RetrieveFunc retrieves a BMC's SDR repository. bmc.RetrieveSDRRepository()
+// is the simplest implementation.
+type RetrieveFunc func(context.Context, bmc.Session) (bmc.SDRRepository, error)
+
+// Retrieve returns the BMC's SDR repository, from the cache if it has not
+// changed, otherwise using the retrieve function, updating the cache. Errors
+// are those of the retrieve function, or a failure to get the SDR repository
+// info; problems with the cache itself are logged, and cause the repository to
+// be retrieved from the BMC.
+func (c *Cache) Retrieve(ctx context.Context, s bmc.Session, retrieve RetrieveFunc) (bmc.SDRRepository, error) {
+	if c == nil {
+		return retrieve(ctx, s)
+	}
+	guid, err := s.GetSystemGUID(ctx)
+	if err != nil || !usable(guid) {
+		// not all BMCs implement Get System GUID
+		misses.Inc()
+		return retrieve(ctx, s)
+	}
+	info, err := s.GetSDRRepositoryInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if e := c.lookup(guid); e != nil && e.valid(info) {
+		repo, err := e.repository()
+		if err == nil {
+			hits.Inc()
+			return repo, nil
+		}
+		log.Printf("ignoring cached SDR repository for %x: %v", guid, err)
+	}
+	misses.Inc()
+	repo, err := retrieve(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	// if the repository changed between getting the info and retrieving it,
+	// the timestamps will not match next time, so we will retrieve it again
+	c.store(guid, newEntry(info, repo))
+	return repo, nil
+}
+
+// lookup returns the entry for a GUID from memory, falling back to disk. It
+// returns nil if there is none.
+func (c *Cache) lookup(guid [16]byte) *entry {
+	c.mu.Lock()
+	e, ok := c.entries[guid]
+	c.mu.Unlock()
+	if ok || c.dir == "" {
+		return e
+	}
+	e, err := c.read(guid)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("failed to read cached SDR repository for %x: %v", guid,
+				err)
+		}
+		return nil
+	}
+	c.mu.Lock()
+	if _, ok := c.entries[guid]; !ok {
+		c.entries[guid] = e
+		entries.Inc()
+	}
+	c.mu.Unlock()
+	return e
+}
+
+// store adds or replaces the entry for a GUID, writing it to disk if the cache
+// has a directory.
+func (c *Cache) store(guid [16]byte, e *entry) {
+	c.mu.Lock()
+	if _, ok := c.entries[guid]; !ok {
+		entries.Inc()
+	}
+	c.entries[guid] = e
+	c.mu.Unlock()
+	if c.dir == "" {
+		return
+	}
+	if err := c.write(guid, e); err != nil {
+		log.Printf("failed to write cached SDR repository for %x: %v", guid,
+			err)
+	}
+}
+
+// path returns the file used to store a GUID's entry.
+func (c *Cache) path(guid [16]byte) string {
+	return filepath.Join(c.dir, hex.EncodeToString(guid[:])+".json")
+}
+
+// read loads a GUID's entry from disk.
+func (c *Cache) read(guid [16]byte) (*entry, error) {
+	b, err := os.ReadFile(c.path(guid))
+	if err != nil {
+		return nil, err
+	}
+	e := &entry{}
+	if err := json.Unmarshal(b, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// write saves a GUID's entry to disk. The file is replaced atomically, so
+// concurrent readers, including future exporter processes, never see a
+// partially written entry.
+func (c *Cache) write(guid [16]byte, e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op after successful rename
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.path(guid))
+}
+
+// newEntry creates an entry for a repository retrieved after obtaining the
+// supplied info.
+func newEntry(info *ipmi.GetSDRRepositoryInfoRsp, repo bmc.SDRRepository) *entry {
+	records := make(map[ipmi.RecordID][]byte, len(repo))
+	for id, fsr := range repo {
+		records[id] = append([]byte(nil), fsr.Contents...)
+	}
+	return &entry{
+		LastAddition: info.LastAddition,
+		LastErase:    info.LastErase,
+		Records:      records,
+	}
+}
+
+// usable returns whether a GUID is likely to uniquely identify a BMC.
+func usable(guid [16]byte) bool {
+	var zero, ones [16]byte
+	for i := range ones {
+		ones[i] = 0xff
+	}
+	return guid != zero && guid != ones
+}
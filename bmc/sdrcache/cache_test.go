@@ -0,0 +1,286 @@
+package sdrcache
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+	"github.com/google/gopacket"
+)
+
+// fsrBytes is the record key and body of a processor temperature sensor named
+// "CPU Temp".
+var fsrBytes = []byte{
+	0x20, 0x00, 0x01, 0x03, 0x01, 0x7f, 0x68, 0x01, 0x01, 0x00, 0x72, 0x00,
+	0x72, 0x3f, 0x3f, 0x80, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x07, 0x28, 0x59, 0xfc, 0x7f, 0x80, 0x64, 0x64, 0x5f, 0x00, 0x00,
+	0x00, 0x02, 0x02, 0x00, 0x00, 0x00, 0xc8, 0x43, 0x50, 0x55, 0x20, 0x54,
+	0x65, 0x6d, 0x70,
+}
+
+var (
+	guid = [16]byte{0xde, 0xad, 0xbe, 0xef, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10,
+		11, 12}
+	epoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// fakeSession implements the commands used by the cache. Calling any other
+// method panics.
+type fakeSession struct {
+	bmc.Session
+
+	guid    [16]byte
+	guidErr error
+	info    ipmi.GetSDRRepositoryInfoRsp
+}
+
+func (s *fakeSession) GetSystemGUID(context.Context) ([16]byte, error) {
+	return s.guid, s.guidErr
+}
+
+func (s *fakeSession) GetSDRRepositoryInfo(context.Context) (*ipmi.GetSDRRepositoryInfoRsp, error) {
+	info := s.info
+	return &info, nil
+}
+
+// counter returns a RetrieveFunc returning a repository containing a single
+// record, and the number of times it has been called.
+func counter(t *testing.T) (RetrieveFunc, *int) {
+	fsr := &ipmi.FullSensorRecord{}
+	if err := fsr.DecodeFromBytes(fsrBytes, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	return func(context.Context, bmc.Session) (bmc.SDRRepository, error) {
+		calls++
+		return bmc.SDRRepository{7: fsr}, nil
+	}, &calls
+}
+
+// checkRepository verifies a repository contains the record returned by
+// counter().
+func checkRepository(t *testing.T, repo bmc.SDRRepository) {
+	t.Helper()
+	if len(repo) != 1 {
+		t.Fatalf("repository has %v records, want 1", len(repo))
+	}
+	fsr, ok := repo[7]
+	if !ok {
+		t.Fatal("record 7 missing")
+	}
+	if fsr.Identity != "CPU Temp" || fsr.BaseUnit != ipmi.SensorUnitCelsius {
+		t.Errorf("record decoded as %q in %v, want CPU Temp in celsius",
+			fsr.Identity, fsr.BaseUnit)
+	}
+	if !bytes.Equal(fsr.Contents, fsrBytes) {
+		t.Errorf("record contents = %x, want %x", fsr.Contents, fsrBytes)
+	}
+}
+
+func TestUsable(t *testing.T) {
+	tests := []struct {
+		guid [16]byte
+		want bool
+	}{
+		{[16]byte{}, false},
+		{[16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, false},
+		{[16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+			0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, true},
+		{[16]byte{15: 1}, true},
+		{guid, true},
+	}
+	for _, test := range tests {
+		if got := usable(test.guid); got != test.want {
+			t.Errorf("usable(%x) = %v, want %v", test.guid, got, test.want)
+		}
+	}
+}
+
+func TestRetrieve(t *testing.T) {
+	tests := []struct {
+		name string
+		guid [16]byte
+
+		// guidErr is returned by Get System GUID.
+		guidErr error
+
+		// change modifies the repository info before the second retrieval.
+		change func(*ipmi.GetSDRRepositoryInfoRsp)
+
+		// wantCalls is the number of times the repository should be retrieved
+		// from the BMC over both retrievals.
+		wantCalls int
+	}{
+		{
+			name:      "unchanged",
+			guid:      guid,
+			wantCalls: 1,
+		},
+		{
+			name: "addition",
+			guid: guid,
+			change: func(info *ipmi.GetSDRRepositoryInfoRsp) {
+				info.LastAddition = info.LastAddition.Add(time.Second)
+			},
+			wantCalls: 2,
+		},
+		{
+			name: "erase",
+			guid: guid,
+			change: func(info *ipmi.GetSDRRepositoryInfoRsp) {
+				info.LastErase = info.LastErase.Add(time.Second)
+			},
+			wantCalls: 2,
+		},
+		{
+			name:      "zero guid",
+			wantCalls: 2,
+		},
+		{
+			name: "ones guid",
+			guid: [16]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+				0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			wantCalls: 2,
+		},
+		{
+			name:      "guid unsupported",
+			guid:      guid,
+			guidErr:   errors.New("invalid command"),
+			wantCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cache, err := New("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &fakeSession{
+				guid:    test.guid,
+				guidErr: test.guidErr,
+				info: ipmi.GetSDRRepositoryInfoRsp{
+					LastAddition: epoch,
+					LastErase:    epoch,
+				},
+			}
+			retrieve, calls := counter(t)
+			for i := 0; i < 2; i++ {
+				if i == 1 && test.change != nil {
+					test.change(&s.info)
+				}
+				repo, err := cache.Retrieve(context.Background(), s, retrieve)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkRepository(t, repo)
+			}
+			if *calls != test.wantCalls {
+				t.Errorf("retrieved %v times, want %v", *calls, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestRetrieveNil(t *testing.T) {
+	cache := (*Cache)(nil)
+	retrieve, calls := counter(t)
+	for i := 0; i < 2; i++ {
+		repo, err := cache.Retrieve(context.Background(), &fakeSession{guid: guid},
+			retrieve)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkRepository(t, repo)
+	}
+	if *calls != 2 {
+		t.Errorf("retrieved %v times, want 2", *calls)
+	}
+}
+
+func TestRetrieveDirectory(t *testing.T) {
+	dir := t.TempDir()
+	s := &fakeSession{
+		guid: guid,
+		info: ipmi.GetSDRRepositoryInfoRsp{
+			LastAddition: epoch,
+			LastErase:    epoch,
+		},
+	}
+	retrieve, calls := counter(t)
+	path := filepath.Join(dir, hex.EncodeToString(guid[:])+".json")
+
+	tests := []struct {
+		name string
+
+		// before is called before creating the cache.
+		before func(t *testing.T)
+
+		// wantCalls is the total number of retrievals expected after the
+		// test.
+		wantCalls int
+	}{
+		{
+			name:      "empty",
+			wantCalls: 1,
+		},
+		{
+			// a new process should read the file written by the first
+			name:      "restart",
+			wantCalls: 1,
+		},
+		{
+			name: "corrupt",
+			before: func(t *testing.T) {
+				if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantCalls: 2,
+		},
+		{
+			// the corrupt file should have been replaced
+			name:      "rewritten",
+			wantCalls: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.before != nil {
+				test.before(t)
+			}
+			cache, err := New(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			repo, err := cache.Retrieve(context.Background(), s, retrieve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRepository(t, repo)
+			if *calls != test.wantCalls {
+				t.Errorf("retrieved %v times in total, want %v", *calls,
+					test.wantCalls)
+			}
+			dirents, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dirents) != 1 || dirents[0].Name() != filepath.Base(path) {
+				names := []string{}
+				for _, dirent := range dirents {
+					names = append(names, dirent.Name())
+				}
+				t.Errorf("directory contains %v, want only %v", names,
+					filepath.Base(path))
+			}
+		})
+	}
+}
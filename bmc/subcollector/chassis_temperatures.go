@@ -0,0 +1,206 @@
+package subcollector
+
+import (
+	"context"
+	"regexp"
+	"sort"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	chassisIntakeTemperature = prometheus.NewDesc(
+		"chassis_intake_temperature_celsius",
+		"The temperature of air entering the chassis in degrees celsius.",
+		nil, nil,
+	)
+	chassisExhaustTemperature = prometheus.NewDesc(
+		"chassis_exhaust_temperature_celsius",
+		"The temperature of air leaving the chassis in degrees celsius.",
+		nil, nil,
+	)
+	chassisIntakeTemperatureThreshold = thresholdDesc(
+		"chassis_intake_temperature_celsius",
+		"The intake temperature thresholds in degrees celsius.",
+	)
+	chassisExhaustTemperatureThreshold = thresholdDesc(
+		"chassis_exhaust_temperature_celsius",
+		"The exhaust temperature thresholds in degrees celsius.",
+	)
+
+	// intakeIdentity and exhaustIdentity match sensor names used by vendors
+	// that do not use the air inlet entity, e.g. Dell's "Inlet Temp" and
+	// "Exhaust Temp", HPE's "01-Inlet Ambient" and Lenovo's "Ambient Temp".
+	intakeIdentity  = regexp.MustCompile(`(?i)inlet|intake|ambient|\bamb\b`)
+	exhaustIdentity = regexp.MustCompile(`(?i)exhaust|outlet`)
+
+	// psuIdentity matches sensors that measure air passing through a power
+	// supply rather than the chassis, which are sometimes not attached to the
+	// power supply entity.
+	psuIdentity = regexp.MustCompile(`(?i)\bpsu?\s?\d|\bpower supply`)
+)
+
+// Candidate priorities, lowest first. A sensor under the air inlet entity is
+// unambiguous, whereas names are a heuristic, and a front panel board sensor
+// with an unhelpful name is a last resort for intake.
+const (
+	priorityAirInlet = iota
+	priorityIdentity
+	priorityFrontPanel
+)
+
+// candidate is a sensor that may measure intake or exhaust temperature.
+type candidate struct {
+	priority int
+	id       ipmi.RecordID
+	fsr      *ipmi.FullSensorRecord
+}
+
+// chassisSensor is a candidate that can be read.
+type chassisSensor struct {
+	reader bmc.SensorReader
+
+	// thresholds are sent alongside the sensor's reading, so they always
+	// describe the sensor that was read.
+	thresholds []prometheus.Metric
+}
+
+// ChassisTemperatures reports the temperature of air entering and leaving the
+// chassis. Unlike processors, the specification gives vendors no consistent
+// way to identify these sensors, so detection uses a combination of entity
+// IDs and sensor names. If several sensors look suitable, the most likely is
+// read, falling back to the others in turn if it has no reading.
+type ChassisTemperatures struct {
+	bmc.Session
+	Thresholds
+
+	// intake and exhaust contain the candidate sensors that can be read, in
+	// descending order of preference. Either may be empty if the BMC has no
+	// suitable sensor.
+	intake  []chassisSensor
+	exhaust []chassisSensor
+}
+
+// Initialise identifies intake and exhaust temperature sensors given an SDR
+// repository.
+func (c *ChassisTemperatures) Initialise(_ context.Context, s bmc.Session, sdrr bmc.SDRRepository) error {
+	c.Session = s
+	intake, exhaust := extractChassisTempFSRs(sdrr)
+	c.intake = c.sensors(intake, chassisIntakeTemperatureThreshold)
+	c.exhaust = c.sensors(exhaust, chassisExhaustTemperatureThreshold)
+	return nil
+}
+
+// extractChassisTempFSRs returns the candidate intake and exhaust temperature
+// sensors in the SDR repository, in descending order of preference.
+func extractChassisTempFSRs(sdrr bmc.SDRRepository) ([]candidate, []candidate) {
+	intake := []candidate{}
+	exhaust := []candidate{}
+	for id, fsr := range sdrr {
+		if fsr.SensorType != ipmi.SensorTypeTemperature {
+			continue
+		}
+		if fsr.BaseUnit != ipmi.SensorUnitCelsius {
+			continue
+		}
+		switch fsr.Entity {
+		case ipmi.EntityIDAirInlet, ipmi.EntityIDDCMIAirInlet:
+			intake = append(intake, candidate{priorityAirInlet, id, fsr})
+			continue
+		case ipmi.EntityIDProcessor, ipmi.EntityIDDCMIProcessor,
+			ipmi.EntityIDProcessorModule, ipmi.EntityIDMemoryModule,
+			ipmi.EntityIDMemoryDevice, ipmi.EntityIDDisk,
+			ipmi.EntityIDPowerSupply, ipmi.EntityIDAddInCard:
+			// components have their own inlets, which are not of interest
+			continue
+		}
+		if psuIdentity.MatchString(fsr.Identity) {
+			continue
+		}
+		switch {
+		case exhaustIdentity.MatchString(fsr.Identity):
+			exhaust = append(exhaust, candidate{priorityIdentity, id, fsr})
+		case intakeIdentity.MatchString(fsr.Identity):
+			intake = append(intake, candidate{priorityIdentity, id, fsr})
+		case fsr.Entity == ipmi.EntityIDFrontPanelBoard:
+			intake = append(intake, candidate{priorityFrontPanel, id, fsr})
+		}
+	}
+	sortCandidates(intake)
+	sortCandidates(exhaust)
+	return intake, exhaust
+}
+
+// sortCandidates orders candidates by priority, then record ID, so the same
+// sensor is chosen each session.
+func sortCandidates(candidates []candidate) {
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].priority != candidates[j].priority {
+			return candidates[i].priority < candidates[j].priority
+		}
+		return candidates[i].id < candidates[j].id
+	})
+}
+
+// sensors creates a reader and thresholds for each candidate, skipping those
+// that cannot be read.
+func (c *ChassisTemperatures) sensors(candidates []candidate, thresholdDesc *prometheus.Desc) []chassisSensor {
+	sensors := make([]chassisSensor, 0, len(candidates))
+	for _, candidate := range candidates {
+		reader, err := bmc.NewSensorReader(candidate.fsr)
+		if err != nil {
+			// requires something not yet implemented (e.g. non-linear); skip
+			continue
+		}
+		sensors = append(sensors, chassisSensor{
+			reader:     reader,
+			thresholds: c.thresholds(thresholdDesc, candidate.fsr),
+		})
+	}
+	return sensors
+}
+
+func (*ChassisTemperatures) Describe(ch chan<- *prometheus.Desc) {
+	ch <- chassisIntakeTemperature
+	ch <- chassisExhaustTemperature
+	ch <- chassisIntakeTemperatureThreshold
+	ch <- chassisExhaustTemperatureThreshold
+}
+
+// Collect reads the intake and exhaust temperatures, producing a sample and the
+// sensor's thresholds for each that has a reading.
+func (c *ChassisTemperatures) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	if err := c.collectFirst(ctx, ch, chassisIntakeTemperature, c.intake); err != nil {
+		return err
+	}
+	return c.collectFirst(ctx, ch, chassisExhaustTemperature, c.exhaust)
+}
+
+// collectFirst produces a sample from the first sensor to return a reading,
+// followed by that sensor's thresholds. An error is only returned if the
+// context expires.
+func (c *ChassisTemperatures) collectFirst(ctx context.Context, ch chan<- prometheus.Metric, desc *prometheus.Desc, sensors []chassisSensor) error {
+	for _, sensor := range sensors {
+		reading, err := sensor.reader.Read(ctx, c.Session)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// machine could be off, or sensor unavailable; try the next
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			desc,
+			prometheus.GaugeValue,
+			reading,
+		)
+		for _, m := range sensor.thresholds {
+			ch <- m
+		}
+		return nil
+	}
+	return nil
+}
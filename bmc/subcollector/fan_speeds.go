@@ -0,0 +1,142 @@
+package subcollector
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	fanSpeed = prometheus.NewDesc(
+		"fan_speed_rpm",
+		"The speed of each fan in revolutions per minute.",
+		[]string{"fan"}, nil,
+	)
+	fanSpeedRatio = prometheus.NewDesc(
+		"fan_speed_ratio",
+		"The speed of each fan as a fraction of its nominal maximum, for "+
+			"fans whose sensor declares one.",
+		[]string{"fan"}, nil,
+	)
+	fanSpeedThreshold = thresholdDesc(
+		"fan_speed_rpm",
+		"The speed thresholds of each fan in revolutions per minute.",
+		"fan",
+	)
+)
+
+// fanSensor is a fan speed sensor.
+type fanSensor struct {
+	reader bmc.SensorReader
+
+	// max is the nominal maximum speed of the fan in RPM, or 0 if the sensor
+	// does not declare one.
+	max float64
+}
+
+// FanSpeeds reports the speed of each fan with an RPM sensor in the SDR
+// repository, allowing a failing fan to be noticed before it causes a cooling
+// fault.
+type FanSpeeds struct {
+	bmc.Session
+	Thresholds
+
+	// sensors holds one reader for each fan speed sensor. The key is the
+	// "fan" label, as a string to save conversion each scrape.
+	sensors map[string]fanSensor
+}
+
+// Initialise identifies fan speed sensors given an SDR repository. Fans are
+// labelled by entity instance, as with PSUs. Some BMCs give every fan the same
+// instance, in which case the sensor number is used instead, so fans remain
+// distinguishable.
+func (c *FanSpeeds) Initialise(_ context.Context, s bmc.Session, sdrr bmc.SDRRepository) error {
+	c.Session = s
+	c.resetThresholds()
+	fsrs := extractFanSpeedFSRs(sdrr)
+
+	instances := make(map[ipmi.EntityInstance]struct{}, len(fsrs))
+	for _, fsr := range fsrs {
+		instances[fsr.Instance] = struct{}{}
+	}
+	unique := len(instances) == len(fsrs)
+
+	sensors := make(map[string]fanSensor, len(fsrs))
+	for _, fsr := range fsrs {
+		reader, err := bmc.NewSensorReader(fsr)
+		if err != nil {
+			// requires something not yet implemented (e.g. non-linear); skip
+			continue
+		}
+		fan := strconv.FormatUint(uint64(fsr.Instance), 10)
+		if !unique {
+			fan = strconv.FormatUint(uint64(fsr.Number), 10)
+		}
+		sensor := fanSensor{
+			reader: reader,
+		}
+		if fsr.NormalMaxSpecified {
+			if nominal, err := convert(fsr, fsr.NormalMax); err == nil && nominal > 0 {
+				sensor.max = nominal
+			}
+		}
+		sensors[fan] = sensor
+		c.addThresholds(fanSpeedThreshold, fsr, fan)
+	}
+	c.sensors = sensors
+	return nil
+}
+
+func extractFanSpeedFSRs(sdrr bmc.SDRRepository) []*ipmi.FullSensorRecord {
+	fsrs := []*ipmi.FullSensorRecord{}
+	for _, fsr := range sdrr {
+		// some BMCs report fan duty cycle as a percentage; only RPM is
+		// comparable between vendors
+		if fsr.SensorType != ipmi.SensorTypeFan {
+			continue
+		}
+		if fsr.BaseUnit != ipmi.SensorUnitRotationsPerMinute {
+			continue
+		}
+		fsrs = append(fsrs, fsr)
+	}
+	return fsrs
+}
+
+func (*FanSpeeds) Describe(ch chan<- *prometheus.Desc) {
+	ch <- fanSpeed
+	ch <- fanSpeedRatio
+	ch <- fanSpeedThreshold
+}
+
+// Collect requests the speed of each identified fan, producing a sample for
+// each one, plus its ratio to the nominal maximum where known.
+func (c *FanSpeeds) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	for fan, sensor := range c.sensors {
+		reading, err := sensor.reader.Read(ctx, c.Session)
+		if err != nil {
+			// machine could be off, or fan absent
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			fanSpeed,
+			prometheus.GaugeValue,
+			reading,
+			fan,
+		)
+		if sensor.max > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				fanSpeedRatio,
+				prometheus.GaugeValue,
+				reading/sensor.max,
+				fan,
+			)
+		}
+	}
+	c.collectThresholds(ch)
+	return nil
+}
@@ -18,10 +18,16 @@ var (
 			"broken down by PSU where possible.",
 		[]string{"psu"}, nil,
 	)
+	powerDrawThreshold = thresholdDesc(
+		"power_draw_watts",
+		"The power draw thresholds of each PSU in watts.",
+		"psu",
+	)
 )
 
 type PowerDraw struct {
 	bmc.Session
+	Thresholds
 
 	// sensors holds one reader for each PSU wattage sensor. The key is the
 	// "psu" label, as a string to save conversion each scrape. Map iteration
@@ -38,6 +44,7 @@ type PowerDraw struct {
 
 func (c *PowerDraw) Initialise(ctx context.Context, s bmc.Session, sdrr bmc.SDRRepository) error {
 	c.Session = s
+	c.resetThresholds()
 	fsrs := extractPowerSupplyFSRs(sdrr)
 	if len(fsrs) > 0 {
 		// the SDR repo's given us some sensors; now get a reader for each of them
@@ -50,6 +57,7 @@ func (c *PowerDraw) Initialise(ctx context.Context, s bmc.Session, sdrr bmc.SDRR
 				continue
 			}
 			readers[psu] = reader
+			c.addThresholds(powerDrawThreshold, fsr, psu)
 		}
 		c.sensors = readers
 		return nil
@@ -96,6 +104,7 @@ func extractPowerSupplyFSRs(sdrr bmc.SDRRepository) []*ipmi.FullSensorRecord {
 
 func (c *PowerDraw) Describe(ch chan<- *prometheus.Desc) {
 	ch <- powerDraw
+	ch <- powerDrawThreshold
 }
 
 func (c *PowerDraw) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
@@ -114,6 +123,7 @@ func (c *PowerDraw) Collect(ctx context.Context, ch chan<- prometheus.Metric) er
 				psu,
 			)
 		}
+		c.collectThresholds(ch)
 	case c.supportsGetPowerReading:
 		if err := bmc.ValidateResponse(c.SendCommand(ctx, &c.getPowerReading)); err != nil {
 			if err != context.DeadlineExceeded {
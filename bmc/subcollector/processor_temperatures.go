@@ -16,10 +16,16 @@ var (
 		"The temperature of each CPU in degrees celsius.",
 		[]string{"cpu"}, nil,
 	)
+	processorTemperatureThreshold = thresholdDesc(
+		"processor_temperature_celsius",
+		"The temperature thresholds of each CPU in degrees celsius.",
+		"cpu",
+	)
 )
 
 type ProcessorTemperatures struct {
 	bmc.Session
+	Thresholds
 
 	// sensors holds one reader for each CPU temperature sensor. The key is the
 	// "cpu" label, as a string to save conversion each scrape. Map iteration
@@ -33,6 +39,7 @@ type ProcessorTemperatures struct {
 // not accept a context.
 func (c *ProcessorTemperatures) Initialise(_ context.Context, s bmc.Session, sdrr bmc.SDRRepository) error {
 	c.Session = s
+	c.resetThresholds()
 	processorFSRs := extractProcessorTempFSRs(sdrr)
 
 	// if we have any sensors under the processor entity ID, prefer those
@@ -54,6 +61,7 @@ func (c *ProcessorTemperatures) Initialise(_ context.Context, s bmc.Session, sdr
 			continue
 		}
 		readers[cpu] = reader
+		c.addThresholds(processorTemperatureThreshold, fsr, cpu)
 	}
 	c.sensors = readers
 	return nil
@@ -82,6 +90,7 @@ func extractProcessorTempFSRs(sdrr bmc.SDRRepository) map[ipmi.EntityID][]*ipmi.
 
 func (*ProcessorTemperatures) Describe(ch chan<- *prometheus.Desc) {
 	ch <- processorTemperature
+	ch <- processorTemperatureThreshold
 }
 
 // Collect requests the temperature of each identified CPU, producing a sample
@@ -100,5 +109,6 @@ func (c *ProcessorTemperatures) Collect(ctx context.Context, ch chan<- prometheu
 			cpu,
 		)
 	}
+	c.collectThresholds(ch)
 	return nil
 }
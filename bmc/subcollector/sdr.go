@@ -0,0 +1,32 @@
+package subcollector
+
+import (
+	"fmt"
+
+	"github.com/gebn/bmc/pkg/ipmi"
+)
+
+// convert turns a raw value from a Full Sensor Record, such as its nominal
+// maximum, into the sensor's unit, in the same way the bmc library converts
+// readings. An error is returned if the sensor does not provide analog
+// readings, or is non-linear.
+func convert(fsr *ipmi.FullSensorRecord, raw uint8) (float64, error) {
+	parser, err := fsr.AnalogDataFormat.Parser()
+	if err != nil {
+		return 0, err
+	}
+	value := fsr.ConvertReading(parser.Parse(raw))
+	switch {
+	case fsr.Linearisation.IsLinear():
+		return value, nil
+	case fsr.Linearisation.IsLinearised():
+		lineariser, err := fsr.Linearisation.Lineariser()
+		if err != nil {
+			return 0, err
+		}
+		return lineariser.Linearise(value), nil
+	default:
+		return 0, fmt.Errorf("unsupported sensor linearisation: %v",
+			fsr.Linearisation)
+	}
+}
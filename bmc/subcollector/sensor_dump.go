@@ -0,0 +1,169 @@
+package subcollector
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	sensorValue = prometheus.NewDesc(
+		"ipmi_sensor_value",
+		"The raw reading of each threshold-based sensor, in its own unit.",
+		[]string{"name", "entity", "entity_instance", "type", "unit"}, nil,
+	)
+	sensorValueThreshold = thresholdDesc(
+		"ipmi_sensor_value",
+		"The thresholds of each threshold-based sensor, in its own unit.",
+		"name", "entity", "entity_instance", "type", "unit",
+	)
+)
+
+// dumpSensor is a sensor exposed by SensorDump.
+type dumpSensor struct {
+	reader bmc.SensorReader
+
+	// labelValues are the values of sensorValue's labels, in order.
+	labelValues []string
+}
+
+// SensorDump exposes every readable threshold-based sensor in the SDR
+// repository as-is, similar to ipmitool's sdr list. Unlike the other
+// subcollectors, nothing is normalised: names and units are whatever the
+// vendor chose, so series are not comparable between models. It exists to
+// provide coverage of sensors that do not have a normalised subcollector yet.
+type SensorDump struct {
+	bmc.Session
+	Thresholds
+
+	// Include, if non-nil, limits the sensors exposed to those whose ID
+	// string matches.
+	Include *regexp.Regexp
+
+	// Exclude, if non-nil, omits sensors whose ID string matches. It takes
+	// precedence over Include.
+	Exclude *regexp.Regexp
+
+	sensors []dumpSensor
+}
+
+// Initialise identifies threshold-based sensors given an SDR repository. If
+// several sensors would produce the same labels, only the one with the lowest
+// record ID is exposed, as Prometheus rejects duplicate series.
+func (c *SensorDump) Initialise(_ context.Context, s bmc.Session, sdrr bmc.SDRRepository) error {
+	c.Session = s
+	c.resetThresholds()
+
+	ids := make([]ipmi.RecordID, 0, len(sdrr))
+	for id, fsr := range sdrr {
+		if fsr.OutputType != ipmi.OutputTypeThreshold {
+			continue
+		}
+		name := sensorName(fsr.Identity)
+		if c.Include != nil && !c.Include.MatchString(name) {
+			continue
+		}
+		if c.Exclude != nil && c.Exclude.MatchString(name) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	seen := make(map[string]struct{}, len(ids))
+	sensors := make([]dumpSensor, 0, len(ids))
+	for _, id := range ids {
+		fsr := sdrr[id]
+		reader, err := bmc.NewSensorReader(fsr)
+		if err != nil {
+			// requires something not yet implemented (e.g. non-linear); skip
+			continue
+		}
+		labelValues := []string{
+			sensorName(fsr.Identity),
+			describe(fsr.Entity.Description(), uint8(fsr.Entity)),
+			strconv.FormatUint(uint64(fsr.Instance), 10),
+			describe(fsr.SensorType.Description(), uint8(fsr.SensorType)),
+			describe(fsr.BaseUnit.Symbol(), uint8(fsr.BaseUnit)),
+		}
+		key := strings.Join(labelValues, "\x00")
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		sensors = append(sensors, dumpSensor{
+			reader:      reader,
+			labelValues: labelValues,
+		})
+		c.addThresholds(sensorValueThreshold, fsr, labelValues...)
+	}
+	c.sensors = sensors
+	return nil
+}
+
+// sensorName converts a sensor's ID string into a label value. The bmc library
+// returns the raw bytes of 8-bit ASCII + Latin 1 strings, which are not valid
+// UTF-8 if they contain characters above 0x7f, and some vendors pad names with
+// NULs rather than spaces.
+func sensorName(identity string) string {
+	runes := make([]rune, len(identity))
+	for i := 0; i < len(identity); i++ {
+		// Latin 1 is the first 256 code points of Unicode
+		runes[i] = rune(identity[i])
+	}
+	return strings.TrimFunc(string(runes), func(r rune) bool {
+		return r == 0 || unicode.IsSpace(r)
+	})
+}
+
+// describe returns a label value for an enumerated SDR field, falling back to
+// its hex value if the bmc library does not know it, e.g. for OEM values.
+func describe(description string, value uint8) string {
+	if description == "Unknown" {
+		return fmt.Sprintf("%#x", value)
+	}
+	return description
+}
+
+func (*SensorDump) Describe(ch chan<- *prometheus.Desc) {
+	ch <- sensorValue
+	ch <- sensorValueThreshold
+}
+
+// Collect reads each identified sensor, producing a sample for each one.
+func (c *SensorDump) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	for _, sensor := range c.sensors {
+		reading, err := sensor.reader.Read(ctx, c.Session)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			// machine could be off, or sensor unavailable
+			continue
+		}
+		metric, err := prometheus.NewConstMetric(
+			sensorValue,
+			prometheus.GaugeValue,
+			reading,
+			sensor.labelValues...,
+		)
+		if err != nil {
+			// vendor-supplied label value Prometheus cannot represent
+			continue
+		}
+		ch <- metric
+	}
+	c.collectThresholds(ch)
+	return nil
+}
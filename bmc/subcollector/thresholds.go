@@ -0,0 +1,123 @@
+package subcollector
+
+import (
+	"github.com/gebn/bmc/pkg/ipmi"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// severities are the values of the severity label of threshold metrics, in the
+// order the thresholds appear in a Full Sensor Record, starting at byte 37.
+// The bit for each in the readable threshold mask is 5 minus its index.
+var severities = [...]string{
+	"upper_non_recoverable",
+	"upper_critical",
+	"upper_non_critical",
+	"lower_non_recoverable",
+	"lower_critical",
+	"lower_non_critical",
+}
+
+const (
+	// thresholdsOffset is the offset of the first threshold in the record
+	// key and body, which is what the bmc library retains in Contents.
+	thresholdsOffset = 31
+
+	// readableMaskOffset is the offset of the readable threshold mask.
+	readableMaskOffset = 13
+
+	// capabilitiesOffset is the offset of the sensor capabilities, which
+	// include whether the sensor has thresholds at all.
+	capabilitiesOffset = 6
+)
+
+// thresholdDesc creates the descriptor for the thresholds of a metric, which
+// has the metric's name suffixed with _threshold, and an extra severity label.
+func thresholdDesc(name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(
+		name+"_threshold",
+		help,
+		append(labels, "severity"), nil,
+	)
+}
+
+// Thresholds is embedded in subcollectors for threshold-based sensors, to
+// optionally expose the thresholds configured by the vendor in each sensor's
+// Full Sensor Record. This allows alerts to use the vendor's limits rather
+// than hard-coding values per model. Thresholds come from the SDR repository,
+// so are obtained during initialisation, and cost no commands to collect.
+// Thresholds changed on the BMC since the SDR was written are not reflected.
+type Thresholds struct {
+	enabled bool
+
+	// metrics contains the threshold metrics found during initialisation.
+	// Const metrics are immutable, so are sent as-is each collection.
+	metrics []prometheus.Metric
+}
+
+// EnableThresholds sets whether the subcollector exposes thresholds. It takes
+// effect the next time the subcollector is initialised.
+func (t *Thresholds) EnableThresholds(enabled bool) {
+	t.enabled = enabled
+}
+
+// resetThresholds forgets thresholds from the previous initialisation. It
+// should be called at the start of Initialise().
+func (t *Thresholds) resetThresholds() {
+	t.metrics = t.metrics[:0]
+}
+
+// addThresholds records the readable thresholds of a sensor, if enabled. The
+// label values are those of the sensor's metric; severity is added.
+func (t *Thresholds) addThresholds(desc *prometheus.Desc, fsr *ipmi.FullSensorRecord, labelValues ...string) {
+	t.metrics = append(t.metrics, t.thresholds(desc, fsr, labelValues...)...)
+}
+
+// thresholds returns the readable thresholds of a sensor, or nil if disabled,
+// for subcollectors that only expose them alongside the sensor's reading. The
+// label values are those of the sensor's metric; severity is added.
+func (t *Thresholds) thresholds(desc *prometheus.Desc, fsr *ipmi.FullSensorRecord, labelValues ...string) []prometheus.Metric {
+	if !t.enabled || fsr.OutputType != ipmi.OutputTypeThreshold {
+		return nil
+	}
+	data := fsr.Contents
+	if len(data) < thresholdsOffset+len(severities) {
+		return nil
+	}
+	if (data[capabilitiesOffset]>>2)&0x3 == 0 {
+		// no thresholds
+		return nil
+	}
+	readable := data[readableMaskOffset]
+	metrics := []prometheus.Metric(nil)
+	for i, severity := range severities {
+		if readable&(1<<(len(severities)-1-i)) == 0 {
+			continue
+		}
+		value, err := convert(fsr, data[thresholdsOffset+i])
+		if err != nil {
+			// the reader would have failed too
+			return nil
+		}
+		metric, err := prometheus.NewConstMetric(
+			desc,
+			prometheus.GaugeValue,
+			value,
+			append(labelValues, severity)...,
+		)
+		if err != nil {
+			// a label value is invalid, so the sensor's other thresholds
+			// would be too
+			return nil
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// collectThresholds sends the thresholds found during initialisation.
+func (t *Thresholds) collectThresholds(ch chan<- prometheus.Metric) {
+	for _, m := range t.metrics {
+		ch <- m
+	}
+}
@@ -0,0 +1,178 @@
+package subcollector
+
+import (
+	"testing"
+
+	"github.com/gebn/bmc/pkg/ipmi"
+	"github.com/google/gopacket"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// thresholdFSR builds the record key and body of a temperature sensor with
+// M = 2 and 2's complement readings, setting the capabilities, readable
+// threshold mask and thresholds at their offsets, then decodes it.
+func thresholdFSR(t *testing.T, capabilities, readable uint8, thresholds [6]uint8) *ipmi.FullSensorRecord {
+	t.Helper()
+	b := []byte{
+		0x20, 0x00, 0x01, // key
+		0x03, 0x01, 0x7f,
+		capabilities,
+		0x01, 0x01, 0x00, 0x72, 0x00, 0x72,
+		readable,
+		0x3f, 0x80, 0x01, 0x00, 0x00,
+		0x02, // M
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x07, 0x28, 0x59, 0xfc, 0x7f, 0x80,
+		thresholds[0], thresholds[1], thresholds[2],
+		thresholds[3], thresholds[4], thresholds[5],
+		0x02, 0x02, 0x00, 0x00, 0x00,
+		0xc8, 0x43, 0x50, 0x55, 0x20, 0x54, 0x65, 0x6d, 0x70,
+	}
+	fsr := &ipmi.FullSensorRecord{}
+	if err := fsr.DecodeFromBytes(b, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return fsr
+}
+
+func TestThresholds(t *testing.T) {
+	desc := thresholdDesc("test", "Test.", "sensor")
+	// 100, 90, 80, -10, 0 and 5 before conversion
+	raw := [6]uint8{0x64, 0x5a, 0x50, 0xf6, 0x00, 0x05}
+
+	tests := []struct {
+		name         string
+		disabled     bool
+		capabilities uint8
+		readable     uint8
+
+		// truncate, if non-zero, shortens the record to this many bytes.
+		truncate int
+
+		// want maps severities to their expected values.
+		want map[string]float64
+	}{
+		{
+			name:         "all readable",
+			capabilities: 0x68,
+			readable:     0x3f,
+			want: map[string]float64{
+				"upper_non_recoverable": 200,
+				"upper_critical":        180,
+				"upper_non_critical":    160,
+				"lower_non_recoverable": -20,
+				"lower_critical":        0,
+				"lower_non_critical":    10,
+			},
+		},
+		{
+			name:         "non-recoverable only",
+			capabilities: 0x68,
+			readable:     0x24,
+			want: map[string]float64{
+				"upper_non_recoverable": 200,
+				"lower_non_recoverable": -20,
+			},
+		},
+		{
+			name:         "lower non-critical only",
+			capabilities: 0x68,
+			readable:     0x01,
+			want: map[string]float64{
+				"lower_non_critical": 10,
+			},
+		},
+		{
+			name:         "readonly thresholds",
+			capabilities: 0x64,
+			readable:     0x10,
+			want: map[string]float64{
+				"upper_critical": 180,
+			},
+		},
+		{
+			name:         "no thresholds",
+			capabilities: 0x60,
+			readable:     0x3f,
+		},
+		{
+			name:         "none readable",
+			capabilities: 0x68,
+			readable:     0x00,
+		},
+		{
+			name:         "truncated",
+			capabilities: 0x68,
+			readable:     0x3f,
+			truncate:     thresholdsOffset + 5,
+		},
+		{
+			name:         "disabled",
+			disabled:     true,
+			capabilities: 0x68,
+			readable:     0x3f,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fsr := thresholdFSR(t, test.capabilities, test.readable, raw)
+			if test.truncate != 0 {
+				fsr.Contents = fsr.Contents[:test.truncate]
+			}
+			th := Thresholds{}
+			th.EnableThresholds(!test.disabled)
+			th.addThresholds(desc, fsr, "cpu")
+
+			got := map[string]float64{}
+			for _, m := range th.metrics {
+				metric := &dto.Metric{}
+				if err := m.Write(metric); err != nil {
+					t.Fatal(err)
+				}
+				labels := map[string]string{}
+				for _, pair := range metric.GetLabel() {
+					labels[pair.GetName()] = pair.GetValue()
+				}
+				if labels["sensor"] != "cpu" {
+					t.Errorf("sensor label = %q, want cpu", labels["sensor"])
+				}
+				got[labels["severity"]] = metric.GetGauge().GetValue()
+			}
+			if len(got) != len(test.want) || len(th.metrics) != len(test.want) {
+				t.Fatalf("thresholds = %v, want %v", got, test.want)
+			}
+			for severity, value := range test.want {
+				if got[severity] != value {
+					t.Errorf("%v = %v, want %v", severity, got[severity],
+						value)
+				}
+			}
+		})
+	}
+}
+
+func TestThresholdsOrder(t *testing.T) {
+	fsr := thresholdFSR(t, 0x68, 0x3f, [6]uint8{6, 5, 4, 3, 2, 1})
+	th := Thresholds{}
+	th.EnableThresholds(true)
+	metrics := th.thresholds(prometheus.NewDesc("test_threshold", "Test.",
+		[]string{"severity"}, nil), fsr)
+	if len(metrics) != len(severities) {
+		t.Fatalf("got %v thresholds, want %v", len(metrics), len(severities))
+	}
+	for i, m := range metrics {
+		metric := &dto.Metric{}
+		if err := m.Write(metric); err != nil {
+			t.Fatal(err)
+		}
+		severity := metric.GetLabel()[0].GetValue()
+		if severity != severities[i] {
+			t.Errorf("threshold %v has severity %v, want %v", i, severity,
+				severities[i])
+		}
+		if want := float64(2 * (6 - i)); metric.GetGauge().GetValue() != want {
+			t.Errorf("%v = %v, want %v", severity,
+				metric.GetGauge().GetValue(), want)
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package subcollector
+
+import (
+	"context"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	voltage = prometheus.NewDesc(
+		"voltage_volts",
+		"The voltage of each power rail in volts.",
+		[]string{"rail"}, nil,
+	)
+	voltageThreshold = thresholdDesc(
+		"voltage_volts",
+		"The voltage thresholds of each power rail in volts.",
+		"rail",
+	)
+
+	// batteryIdentity matches the CMOS battery, e.g. "VBAT", "3VBAT",
+	// "CMOS Battery" and "P3V_BAT".
+	batteryIdentity = regexp.MustCompile(`(?i)bat|cmos`)
+
+	// vcoreIdentity matches processor core voltages, e.g. "CPU1 VCORE" and
+	// "VCPU0".
+	vcoreIdentity = regexp.MustCompile(`(?i)vcore|vcpu`)
+
+	// digits finds a processor number in a sensor name.
+	digits = regexp.MustCompile(`\d+`)
+
+	// voltageToken matches the nominal voltage in a name token, e.g. "12v",
+	// "p12v", "3v3", "p3v3", "3.3v" and "5vsb", capturing the integer part,
+	// fractional part, and any standby suffix.
+	voltageToken = regexp.MustCompile(`^p?(\d+)(?:v(\d+)|\.(\d+))?v?(sb|stby)?$`)
+
+	// separators splits a sensor name into tokens.
+	separators = regexp.MustCompile(`[^a-z0-9.]+`)
+)
+
+// Voltages reports the voltage of each power rail with a sensor in the SDR
+// repository. Vendors name rails inconsistently, e.g. "P12V", "12V" and
+// "+12V", so names are normalised into a rail label such as "12v", "3.3v",
+// "5v_standby", "vbat" or "cpu1_vcore".
+type Voltages struct {
+	bmc.Session
+	Thresholds
+
+	// sensors holds one reader for each voltage sensor. The key is the "rail"
+	// label.
+	sensors map[string]bmc.SensorReader
+}
+
+// Initialise identifies voltage sensors given an SDR repository.
+func (c *Voltages) Initialise(_ context.Context, s bmc.Session, sdrr bmc.SDRRepository) error {
+	c.Session = s
+	c.resetThresholds()
+	fsrs := extractVoltageFSRs(sdrr)
+
+	// if two sensors normalise to the same rail, distinguish them by sensor
+	// number rather than dropping one
+	rails := make(map[*ipmi.FullSensorRecord]string, len(fsrs))
+	counts := map[string]int{}
+	for _, fsr := range fsrs {
+		rail := normaliseRail(fsr)
+		rails[fsr] = rail
+		counts[rail]++
+	}
+
+	readers := make(map[string]bmc.SensorReader, len(fsrs))
+	for _, fsr := range fsrs {
+		reader, err := bmc.NewSensorReader(fsr)
+		if err != nil {
+			// requires something not yet implemented (e.g. non-linear); skip
+			continue
+		}
+		rail := rails[fsr]
+		if counts[rail] > 1 {
+			rail += "_" + strconv.FormatUint(uint64(fsr.Number), 10)
+		}
+		readers[rail] = reader
+		c.addThresholds(voltageThreshold, fsr, rail)
+	}
+	c.sensors = readers
+	return nil
+}
+
+func extractVoltageFSRs(sdrr bmc.SDRRepository) []*ipmi.FullSensorRecord {
+	fsrs := []*ipmi.FullSensorRecord{}
+	for _, fsr := range sdrr {
+		if fsr.SensorType != ipmi.SensorTypeVoltage {
+			continue
+		}
+		if fsr.BaseUnit != ipmi.SensorUnitVolts {
+			continue
+		}
+		fsrs = append(fsrs, fsr)
+	}
+	return fsrs
+}
+
+// normaliseRail derives a rail label from a voltage sensor's name and entity.
+func normaliseRail(fsr *ipmi.FullSensorRecord) string {
+	name := strings.ToLower(strings.TrimSpace(fsr.Identity))
+	isProcessor := fsr.Entity == ipmi.EntityIDProcessor ||
+		fsr.Entity == ipmi.EntityIDDCMIProcessor
+	switch {
+	case batteryIdentity.MatchString(name):
+		return "vbat"
+	case vcoreIdentity.MatchString(name):
+		var cpu string
+		if isProcessor {
+			cpu = strconv.FormatUint(uint64(fsr.Instance), 10)
+		} else {
+			cpu = digits.FindString(name)
+		}
+		return "cpu" + cpu + "_vcore"
+	}
+
+	tokens := []string{}
+	for _, token := range separators.Split(name, -1) {
+		if token == "" {
+			continue
+		}
+		if m := voltageToken.FindStringSubmatch(token); m != nil &&
+			strings.ContainsAny(token, "v.") {
+			rail := m[1]
+			if frac := m[2] + m[3]; frac != "" {
+				rail += "." + frac
+			}
+			tokens = append(tokens, rail+"v")
+			if m[4] != "" {
+				tokens = append(tokens, "standby")
+			}
+			continue
+		}
+		switch token {
+		case "sb", "stby":
+			token = "standby"
+		}
+		tokens = append(tokens, token)
+	}
+	rail := strings.Join(tokens, "_")
+	if rail == "" {
+		rail = "sensor" + strconv.FormatUint(uint64(fsr.Number), 10)
+	}
+	if isProcessor && !strings.Contains(rail, "cpu") {
+		rail = "cpu" + strconv.FormatUint(uint64(fsr.Instance), 10) + "_" + rail
+	}
+	return rail
+}
+
+func (*Voltages) Describe(ch chan<- *prometheus.Desc) {
+	ch <- voltage
+	ch <- voltageThreshold
+}
+
+// Collect requests the voltage of each identified rail, producing a sample for
+// each one.
+func (c *Voltages) Collect(ctx context.Context, ch chan<- prometheus.Metric) error {
+	for rail, reader := range c.sensors {
+		reading, err := reader.Read(ctx, c.Session)
+		if err != nil {
+			// machine could be off
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			voltage,
+			prometheus.GaugeValue,
+			reading,
+			rail,
+		)
+	}
+	c.collectThresholds(ch)
+	return nil
+}
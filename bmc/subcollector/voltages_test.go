@@ -0,0 +1,137 @@
+package subcollector
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/gebn/bmc"
+	"github.com/gebn/bmc/pkg/ipmi"
+)
+
+// voltageFSR creates a linear voltage sensor record.
+func voltageFSR(number uint8, identity string) *ipmi.FullSensorRecord {
+	return &ipmi.FullSensorRecord{
+		SensorRecordKey: ipmi.SensorRecordKey{
+			Number: number,
+		},
+		Entity:     ipmi.EntityIDSystemBoard,
+		SensorType: ipmi.SensorTypeVoltage,
+		OutputType: ipmi.OutputTypeThreshold,
+		BaseUnit:   ipmi.SensorUnitVolts,
+		Identity:   identity,
+	}
+}
+
+func TestNormaliseRail(t *testing.T) {
+	tests := []struct {
+		identity string
+		entity   ipmi.EntityID
+		instance ipmi.EntityInstance
+		number   uint8
+		want     string
+	}{
+		{identity: "P12V", want: "12v"},
+		{identity: "12V", want: "12v"},
+		{identity: "+12V", want: "12v"},
+		{identity: " 12V  ", want: "12v"},
+		{identity: "P3V3", want: "3.3v"},
+		{identity: "3.3V", want: "3.3v"},
+		{identity: "5VSB", want: "5v_standby"},
+		{identity: "P5V_STBY", want: "5v_standby"},
+		{identity: "5V SB", want: "5v_standby"},
+		{identity: "VBAT", want: "vbat"},
+		{identity: "3VBAT", want: "vbat"},
+		{identity: "P3V_BAT", want: "vbat"},
+		{identity: "CMOS Battery", want: "vbat"},
+		{identity: "CPU1 VCORE", want: "cpu1_vcore"},
+		{identity: "VCPU0", want: "cpu0_vcore"},
+		{
+			identity: "Vcore",
+			entity:   ipmi.EntityIDProcessor,
+			instance: 2,
+			want:     "cpu2_vcore",
+		},
+		{
+			identity: "P1V8",
+			entity:   ipmi.EntityIDProcessor,
+			instance: 1,
+			want:     "cpu1_1.8v",
+		},
+		{identity: "PVDDQ ABC", want: "pvddq_abc"},
+		{identity: "", number: 9, want: "sensor9"},
+	}
+	for _, test := range tests {
+		t.Run(test.identity, func(t *testing.T) {
+			fsr := voltageFSR(test.number, test.identity)
+			if test.entity != 0 {
+				fsr.Entity = test.entity
+			}
+			fsr.Instance = test.instance
+			if got := normaliseRail(fsr); got != test.want {
+				t.Errorf("normaliseRail(%q) = %q, want %q", test.identity,
+					got, test.want)
+			}
+		})
+	}
+}
+
+func TestVoltagesRails(t *testing.T) {
+	tests := []struct {
+		name string
+		sdrr bmc.SDRRepository
+		want []string
+	}{
+		{
+			name: "distinct",
+			sdrr: bmc.SDRRepository{
+				1: voltageFSR(1, "P12V"),
+				2: voltageFSR(2, "P5V"),
+				3: voltageFSR(3, "VBAT"),
+			},
+			want: []string{"12v", "5v", "vbat"},
+		},
+		{
+			name: "duplicates",
+			sdrr: bmc.SDRRepository{
+				1: voltageFSR(3, "P12V"),
+				2: voltageFSR(4, "+12V"),
+				3: voltageFSR(5, "P5V"),
+			},
+			want: []string{"12v_3", "12v_4", "5v"},
+		},
+		{
+			name: "not voltage",
+			sdrr: bmc.SDRRepository{
+				1: voltageFSR(1, "P12V"),
+				2: &ipmi.FullSensorRecord{
+					Identity:   "12V Temp",
+					SensorType: ipmi.SensorTypeTemperature,
+					BaseUnit:   ipmi.SensorUnitCelsius,
+				},
+			},
+			want: []string{"12v"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := &Voltages{}
+			if err := c.Initialise(context.Background(), nil, test.sdrr); err != nil {
+				t.Fatal(err)
+			}
+			got := []string{}
+			for rail := range c.sensors {
+				got = append(got, rail)
+			}
+			sort.Strings(got)
+			if len(got) != len(test.want) {
+				t.Fatalf("rails = %v, want %v", got, test.want)
+			}
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Fatalf("rails = %v, want %v", got, test.want)
+				}
+			}
+		})
+	}
+}
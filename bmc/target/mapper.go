@@ -139,6 +139,31 @@ func (m *Mapper) gc() {
 	mapperGcTargetsCleared.Observe(float64(expired))
 }
 
+// CloseSessions closes the sessions of targets whose addrs satisfy the
+// predicate, leaving the targets themselves in place. This is intended to be
+// called when credentials change, so the next scrape of each affected target
+// re-authenticates.
+func (m *Mapper) CloseSessions(shouldClose func(addr string) bool) {
+	toClose := []*Target{}
+	m.mu.RLock()
+	for addr, t := range m.targets {
+		if shouldClose(addr) {
+			toClose = append(toClose, t)
+		}
+	}
+	m.mu.RUnlock()
+
+	wg := sync.WaitGroup{}
+	wg.Add(len(toClose))
+	for _, t := range toClose {
+		go func(t *Target) {
+			defer wg.Done()
+			t.CloseSession()
+		}(t)
+	}
+	wg.Wait()
+}
+
 func (m *Mapper) Close() {
 	// if a GC is in progress, we may have GC closing some targets while we
 	// close the rest - this is fine as they will never try to close the same
@@ -38,6 +38,15 @@ var (
 			"because they gave up or one of our timeouts fired. This " +
 			"indicates an overly short scrape timeout and/or interval.",
 	})
+
+	sessionInvalidations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "session_invalidations_total",
+		Help: "The number of times a target's session was closed because " +
+			"its credentials changed or were removed. Targets without a " +
+			"session at the time are not counted.",
+	})
 )
 
 type scrapeReqOpts struct {
@@ -59,29 +68,43 @@ type scrapeReqOpts struct {
 type Target struct {
 	collector *collector.Collector
 
+	// keepalive is how long the session can be idle before the event loop
+	// sends a command to stop it expiring. Zero disables keepalives.
+	keepalive time.Duration
+
 	// handler is the underlying promhttp handler that displays the metrics
 	// page. Note that this struct also implements http.Handler, but only
 	// performs management around delegating to this.
 	handler http.Handler
 
-	scrapeReq chan scrapeReqOpts
-	closeReq  chan struct{}
+	scrapeReq       chan scrapeReqOpts
+	closeSessionReq chan struct{}
+	closeReq        chan struct{}
+
+	// done is closed when the event loop has stopped. Unlike the request
+	// channels, it is safe to select on after the target has been closed.
+	done chan struct{}
 
 	// wg becomes done when the event loop has stopped.
 	wg sync.WaitGroup
 }
 
-// New constructs and starts a new BMC target. Be sure to call Close() when
-// finished with it to terminate the event loop and underlying BMC connection.
-func New(c *collector.Collector) *Target {
+// New constructs and starts a new BMC target. If keepalive is non-zero, a
+// command is sent over the session whenever it has been idle for that long.
+// Be sure to call Close() when finished with it to terminate the event loop
+// and underlying BMC connection.
+func New(c *collector.Collector, keepalive time.Duration) *Target {
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(c)
 
 	bmc := &Target{
-		collector: c,
-		handler:   promhttp.HandlerFor(reg, handlerOpts),
-		scrapeReq: make(chan scrapeReqOpts),
-		closeReq:  make(chan struct{}),
+		collector:       c,
+		keepalive:       keepalive,
+		handler:         promhttp.HandlerFor(reg, handlerOpts),
+		scrapeReq:       make(chan scrapeReqOpts),
+		closeSessionReq: make(chan struct{}),
+		closeReq:        make(chan struct{}),
+		done:            make(chan struct{}),
 	}
 
 	bmc.wg.Add(1)
@@ -91,6 +114,16 @@ func New(c *collector.Collector) *Target {
 
 func (t *Target) eventLoop() {
 	defer t.wg.Done()
+	defer close(t.done)
+
+	// keepalive remains nil if keepalives are disabled, so never fires
+	var keepalive <-chan time.Time
+	var keepaliveTimer *time.Timer
+	if t.keepalive > 0 {
+		keepaliveTimer = time.NewTimer(t.keepalive)
+		defer keepaliveTimer.Stop()
+		keepalive = keepaliveTimer.C
+	}
 	for {
 		// the fact we can only do one thing at once ensures requests to a given
 		// BMC are serialised
@@ -112,6 +145,25 @@ func (t *Target) eventLoop() {
 			// a stack overflow
 			t.handler.ServeHTTP(req.ResponseWriter, req.Request)
 			req.Done <- struct{}{}
+			if keepaliveTimer != nil {
+				keepaliveTimer.Reset(t.keepalive)
+			}
+		case <-keepalive:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+			t.collector.Keepalive(ctx)
+			cancel()
+			keepaliveTimer.Reset(t.keepalive)
+		case <-t.closeSessionReq:
+			// the collector remains usable; the next scrape will establish a
+			// new session with whatever credentials are now current, even if
+			// the old ones were failing
+			if t.collector.HasSession() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
+				t.collector.Close(ctx)
+				cancel()
+				sessionInvalidations.Inc()
+			}
+			t.collector.ResetBackoff()
 		case <-t.closeReq:
 			ctx, cancel := context.WithTimeout(context.Background(), time.Second*2)
 			t.collector.Close(ctx)
@@ -156,6 +208,18 @@ func (t *Target) LastCollection() int64 {
 	return t.collector.LastCollection()
 }
 
+// CloseSession closes the target's current session, if any, without closing
+// the target itself. This is used when the target's credentials change, to
+// force the next scrape to re-authenticate. It waits for any in-progress
+// scrape to finish, and is safe to call concurrently with Close().
+func (t *Target) CloseSession() {
+	select {
+	case t.closeSessionReq <- struct{}{}:
+	case <-t.done:
+		// target has been closed, taking the session with it
+	}
+}
+
 // Close cleanly terminates the connection and resources associated with the
 // BMC. This method must only be called once, otherwise it will panic.
 func (t *Target) Close() {
@@ -15,10 +15,14 @@ import (
 	"time"
 
 	"github.com/gebn/bmc_exporter/bmc/collector"
+	"github.com/gebn/bmc_exporter/bmc/sdrcache"
+	"github.com/gebn/bmc_exporter/bmc/subcollector"
 	"github.com/gebn/bmc_exporter/bmc/target"
 	"github.com/gebn/bmc_exporter/handler/bmc"
+	"github.com/gebn/bmc_exporter/handler/reload"
 	"github.com/gebn/bmc_exporter/handler/root"
-	"github.com/gebn/bmc_exporter/session/file"
+	"github.com/gebn/bmc_exporter/session"
+	"github.com/gebn/bmc_exporter/session/config"
 
 	"github.com/alecthomas/kingpin"
 	"github.com/gebn/go-stamp/v2"
@@ -79,15 +83,204 @@ var (
 		"is being scraped by multiple Prometheis.").
 		Default("9s"). // network RTT
 		Duration()
+	collectStaleMaxAge = kingpin.Flag("collect.stale-max-age", "If a "+
+		"subcollector cannot collect fresh metrics before the collect "+
+		"timeout, serve the last values it successfully collected, provided "+
+		"they are no older than this. bmc_metric_age_seconds indicates when "+
+		"this has happened. Set to 0 to disable.").
+		Default("0").
+		Duration()
+	collectThresholds = kingpin.Flag("collect.thresholds", "Expose the "+
+		"thresholds of threshold-based sensors from their full sensor "+
+		"records, as *_threshold metrics with a severity label, e.g. "+
+		"processor_temperature_celsius_threshold{severity=\"upper_critical\"}.").
+		Bool()
+	collectSensorDump = kingpin.Flag("collect.sensor-dump", "Expose every "+
+		"threshold-based sensor as ipmi_sensor_value, with the name, entity "+
+		"and unit reported by the BMC. These are not normalised, so are not "+
+		"comparable between vendors; prefer the other metrics where "+
+		"available.").
+		Bool()
+	collectSensorDumpInclude = kingpin.Flag("collect.sensor-dump.include",
+		"Only expose sensors whose ID string matches this regular "+
+			"expression with --collect.sensor-dump.").
+		Regexp()
+	collectSensorDumpExclude = kingpin.Flag("collect.sensor-dump.exclude",
+		"Do not expose sensors whose ID string matches this regular "+
+			"expression with --collect.sensor-dump. Takes precedence over "+
+			"--collect.sensor-dump.include.").
+		Regexp()
+	sessionInitialBackoff = kingpin.Flag("session.backoff.initial", "Time "+
+		"to wait before retrying after failing to establish a session with a "+
+		"BMC, e.g. because it is down or rejected our credentials. This "+
+		"doubles with each consecutive failure. Set to 0 to try every scrape.").
+		Default("1m").
+		Duration()
+	sessionMaxBackoff = kingpin.Flag("session.backoff.max", "Maximum time to "+
+		"wait between attempts to establish a session with a BMC.").
+		Default("10m").
+		Duration()
+	sessionKeepalive = kingpin.Flag("session.keepalive", "Send a command "+
+		"over a BMC's session whenever it has been idle for this long, to "+
+		"stop the BMC expiring it between scrapes. Set this below the BMC's "+
+		"session timeout, typically 60s, if the scrape interval is longer. "+
+		"Set to 0 to disable.").
+		Default("0").
+		Duration()
+	sessionConcurrency = kingpin.Flag("session.concurrency", "Maximum "+
+		"number of sessions that can be established, including walking the "+
+		"SDR repository, at once across all BMCs. Scrapes closest to their "+
+		"deadline are admitted first. This avoids saturating the exporter "+
+		"and management network on startup. Set to 0 for no limit.").
+		Default("0").
+		Int()
+	sdrCache = kingpin.Flag("sdr.cache", "Cache each BMC's SDR "+
+		"repository in memory, keyed by its system GUID, so re-establishing "+
+		"a session only retrieves it again if a record was added or erased.").
+		Bool()
+	sdrCacheDirectory = kingpin.Flag("sdr.cache.directory", "Directory to "+
+		"also store cached SDR repositories in, so they survive restarts. "+
+		"Implies --sdr.cache.").
+		String()
+	secretsConfig = kingpin.Flag("secrets.config", "YAML file listing "+
+		"session providers to try in order for each target. If set, the "+
+		"other --secrets flags are ignored.").
+		String()
+	secretsProvider = kingpin.Flag("secrets.provider", "The session "+
+		"provider to obtain BMC credentials from, when --secrets.config is "+
+		"not set.").
+		Default("static").
+		Enum("static", "vault", "broker", "directory", "helper")
 	secretsStatic = kingpin.Flag("secrets.static", "Credentials file used by "+
 		"the static session provider.").
 		Default("secrets.yml").
 		String() // we don't use ExistingFile() due to kingpin issue #261
+	secretsStaticReloadInterval = kingpin.Flag("secrets.static.reload-interval",
+		"How often to check the credentials file for changes, reloading it "+
+			"if it has been modified. The file is also reloaded on SIGHUP and "+
+			"POST /-/reload. Set to 0 to disable polling.").
+		Default("30s").
+		Duration()
+	secretsStaticKey = kingpin.Flag("secrets.static.key", "Base64-encoded "+
+		"256-bit key to decrypt the credentials file with, if it is "+
+		"encrypted. Prefer setting the BMC_EXPORTER_SECRETS_KEY environment "+
+		"variable or --secrets.static.key-file to passing this on the "+
+		"command line.").
+		Envar("BMC_EXPORTER_SECRETS_KEY").
+		String()
+	secretsStaticKeyFile = kingpin.Flag("secrets.static.key-file", "File "+
+		"containing the base64-encoded key to decrypt the credentials file "+
+		"with. Takes precedence over --secrets.static.key.").
+		String()
+	secretsDirectory = kingpin.Flag("secrets.directory", "Directory used by "+
+		"the directory session provider, e.g. a mounted Kubernetes Secret, "+
+		"containing one file or subdirectory per target.").
+		String()
+	secretsDirectoryReloadInterval = kingpin.Flag(
+		"secrets.directory.reload-interval", "How often to check the "+
+			"credentials directory for changes. The directory is also "+
+			"reloaded on SIGHUP and POST /-/reload. Set to 0 to disable "+
+			"polling.").
+		Default("30s").
+		Duration()
+	secretsVaultAddress = kingpin.Flag("secrets.vault.address", "Base URL "+
+		"of the Vault server used by the vault session provider.").
+		Envar("VAULT_ADDR").
+		String()
+	secretsVaultNamespace = kingpin.Flag("secrets.vault.namespace", "Vault "+
+		"Enterprise namespace to use, if any.").
+		Envar("VAULT_NAMESPACE").
+		String()
+	secretsVaultCAFile = kingpin.Flag("secrets.vault.ca-file", "PEM file of "+
+		"CA certificates to verify the Vault server against, instead of the "+
+		"system pool.").
+		String()
+	secretsVaultToken = kingpin.Flag("secrets.vault.token", "Token to "+
+		"authenticate to Vault with. Prefer setting the VAULT_TOKEN "+
+		"environment variable to passing this on the command line.").
+		Envar("VAULT_TOKEN").
+		String()
+	secretsVaultRoleID = kingpin.Flag("secrets.vault.approle.role-id",
+		"AppRole role ID to authenticate to Vault with, instead of a token.").
+		String()
+	secretsVaultSecretIDFile = kingpin.Flag("secrets.vault.approle.secret-id-file",
+		"File containing the AppRole secret ID. Re-read on reload.").
+		String()
+	secretsVaultAppRoleMount = kingpin.Flag("secrets.vault.approle.mount",
+		"Path the AppRole auth method is mounted at.").
+		Default("approle").
+		String()
+	secretsVaultMount = kingpin.Flag("secrets.vault.mount", "Path the KV v2 "+
+		"secrets engine holding BMC credentials is mounted at.").
+		Default("secret").
+		String()
+	secretsVaultPath = kingpin.Flag("secrets.vault.path", "Path of each "+
+		"BMC's secret within the mount, with {addr} replaced by the target.").
+		Default("bmc/{addr}").
+		String()
+	secretsVaultTTL = kingpin.Flag("secrets.vault.cache-ttl", "How long to "+
+		"cache credentials retrieved from Vault when it does not specify a "+
+		"lease duration.").
+		Default("5m").
+		Duration()
+	secretsBrokerURL = kingpin.Flag("secrets.broker.url", "URL to request "+
+		"each BMC's credentials from when using the broker session provider, "+
+		"with {addr} replaced by the target.").
+		String()
+	secretsBrokerBearerTokenFile = kingpin.Flag("secrets.broker.bearer-token-file",
+		"File containing a bearer token to authenticate to the broker with. "+
+			"Re-read on reload.").
+		String()
+	secretsBrokerCAFile = kingpin.Flag("secrets.broker.ca-file", "PEM file "+
+		"of CA certificates to verify the broker against, instead of the "+
+		"system pool.").
+		String()
+	secretsBrokerCertFile = kingpin.Flag("secrets.broker.cert-file", "PEM "+
+		"client certificate to present to the broker for mTLS.").
+		String()
+	secretsBrokerKeyFile = kingpin.Flag("secrets.broker.key-file", "PEM "+
+		"private key of the client certificate.").
+		String()
+	secretsBrokerTimeout = kingpin.Flag("secrets.broker.timeout", "Maximum "+
+		"time allowed for each request to the broker.").
+		Default("2s").
+		Duration()
+	secretsBrokerRetries = kingpin.Flag("secrets.broker.retries", "Maximum "+
+		"number of times to retry a request to the broker that failed with a "+
+		"network error or 5xx. Set to 0 to disable retries.").
+		Default("3").
+		Uint64()
+	secretsBrokerNegativeTTL = kingpin.Flag("secrets.broker.negative-cache-ttl",
+		"How long to remember that the broker does not know a target. Set to "+
+			"0 to ask every scrape.").
+		Default("1m").
+		Duration()
+	secretsHelperCommand = kingpin.Flag("secrets.helper.command", "Program "+
+		"to run to obtain each BMC's credentials when using the helper "+
+		"session provider.").
+		String()
+	secretsHelperArgs = kingpin.Flag("secrets.helper.arg", "Argument to "+
+		"pass to the credential helper before the target. Repeat for "+
+		"multiple arguments.").
+		Strings()
+	secretsHelperStdin = kingpin.Flag("secrets.helper.stdin", "Pass the "+
+		"target to the credential helper on stdin rather than as its final "+
+		"argument.").
+		Bool()
+	secretsHelperTimeout = kingpin.Flag("secrets.helper.timeout", "Maximum "+
+		"time allowed for each run of the credential helper.").
+		Default("5s").
+		Duration()
+	secretsHelperTTL = kingpin.Flag("secrets.helper.cache-ttl", "How long to "+
+		"cache the credential helper's output for each target. Set to 0 to "+
+		"run the helper every time a session is established.").
+		Default("5m").
+		Duration()
 )
 
 func init() {
 	maxprocs.Set() // use the library this way to avoid logging when CPU quota is undefined
-	for _, path := range []string{"/", "/bmc", "/metrics"} {
+	for _, path := range []string{"/", "/bmc", "/metrics", "/-/reload"} {
 		requestDuration.WithLabelValues(path)
 	}
 	buildInfo.WithLabelValues(stamp.Version, stamp.Commit).Set(1)
@@ -100,23 +293,71 @@ func main() {
 	kingpin.Version(stamp.Summary())
 	kingpin.Parse()
 
-	provider, err := file.New(*secretsStatic)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	provider, err := newProvider(ctx)
 	if err != nil {
 		log.Fatal(err)
 	}
+	reloadProvider := func() error {
+		reloader, ok := provider.(session.Reloader)
+		if !ok {
+			return nil
+		}
+		if err := reloader.Reload(); err != nil {
+			log.Printf("failed to reload %v provider: %v", *secretsProvider, err)
+			return err
+		}
+		log.Printf("reloaded %v provider", *secretsProvider)
+		return nil
+	}
 
+	var cache *sdrcache.Cache
+	if *sdrCache || *sdrCacheDirectory != "" {
+		cache, err = sdrcache.New(*sdrCacheDirectory)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var limiter *collector.Limiter
+	if *sessionConcurrency > 0 {
+		limiter = collector.NewLimiter(*sessionConcurrency)
+	}
 	mapper := target.NewMapper(target.ProviderFunc(func(addr string) *target.Target {
+		var sensorDump *subcollector.SensorDump
+		if *collectSensorDump {
+			sensorDump = &subcollector.SensorDump{
+				Include: *collectSensorDumpInclude,
+				Exclude: *collectSensorDumpExclude,
+			}
+		}
 		return target.New(&collector.Collector{
-			Target:   addr,
-			Provider: provider,
-			Timeout:  *collectTimeout,
-		})
+			Target:      addr,
+			Provider:    provider,
+			Timeout:     *collectTimeout,
+			StaleMaxAge: *collectStaleMaxAge,
+			Thresholds:  *collectThresholds,
+			SensorDump:  sensorDump,
+
+			InitialBackoff: *sessionInitialBackoff,
+			MaxBackoff:     *sessionMaxBackoff,
+			Limiter:        limiter,
+			SDRCache:       cache,
+		}, *sessionKeepalive)
 	}))
 	defer mapper.Close()
+	if notifier, ok := provider.(session.ChangeNotifier); ok {
+		notifier.OnChange(func(changed func(addr string) bool) {
+			// don't hold up the reload waiting for in-progress scrapes
+			go mapper.CloseSessions(changed)
+		})
+	}
 
 	registerHandler("/", root.Handler())
 	registerHandler("/bmc", bmc.Handler(mapper, *scrapeTimeout))
 	registerHandler("/metrics", promhttp.Handler())
+	registerHandler("/-/reload", reload.Handler(reloadProvider))
 
 	listener, err := net.Listen("tcp", *listenAddr)
 	if err != nil {
@@ -147,9 +388,20 @@ func main() {
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+wait:
+	for {
+		select {
+		case <-hup:
+			// errors are logged; the previous config remains in effect
+			reloadProvider()
+		case <-quit:
+			break wait
+		}
+	}
 	fmt.Println() // avoids "^C" being printed on the same line as the log date
 	log.Println("waiting for in-progress requests to finish...")
 
@@ -161,6 +413,80 @@ func main() {
 	wg.Wait()
 }
 
+// newProvider creates the session provider chain described by
+// --secrets.config, or the single provider selected by --secrets.provider if
+// that is not set. Any background work, e.g. watching for config changes,
+// stops when the context is cancelled.
+func newProvider(ctx context.Context) (session.Provider, error) {
+	if *secretsConfig != "" {
+		chain, err := config.Load(ctx, *secretsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return chain, nil
+	}
+	// translate the flags into the equivalent config file entry, so there is
+	// one way to create each provider
+	var c interface {
+		New(context.Context) (session.CredentialsRetriever, error)
+	}
+	switch *secretsProvider {
+	case "vault":
+		c = &config.Vault{
+			Address:      *secretsVaultAddress,
+			Namespace:    *secretsVaultNamespace,
+			CAFile:       *secretsVaultCAFile,
+			Token:        *secretsVaultToken,
+			RoleID:       *secretsVaultRoleID,
+			SecretIDFile: *secretsVaultSecretIDFile,
+			AppRoleMount: *secretsVaultAppRoleMount,
+			Mount:        *secretsVaultMount,
+			Path:         *secretsVaultPath,
+			CacheTTL:     *secretsVaultTTL,
+			Retries:      3,
+			Timeout:      time.Second * 5,
+		}
+	case "broker":
+		c = &config.Broker{
+			URL:              *secretsBrokerURL,
+			BearerTokenFile:  *secretsBrokerBearerTokenFile,
+			CAFile:           *secretsBrokerCAFile,
+			CertFile:         *secretsBrokerCertFile,
+			KeyFile:          *secretsBrokerKeyFile,
+			Timeout:          *secretsBrokerTimeout,
+			Retries:          *secretsBrokerRetries,
+			NegativeCacheTTL: *secretsBrokerNegativeTTL,
+		}
+	case "directory":
+		c = &config.Directory{
+			Path:           *secretsDirectory,
+			ReloadInterval: *secretsDirectoryReloadInterval,
+		}
+	case "helper":
+		c = &config.Helper{
+			Command:  append([]string{*secretsHelperCommand}, *secretsHelperArgs...),
+			Stdin:    *secretsHelperStdin,
+			Timeout:  *secretsHelperTimeout,
+			CacheTTL: *secretsHelperTTL,
+		}
+	default:
+		c = &config.Static{
+			Path:           *secretsStatic,
+			KeyFile:        *secretsStaticKeyFile,
+			ReloadInterval: *secretsStaticReloadInterval,
+			Key:            *secretsStaticKey,
+		}
+	}
+	retriever, err := c.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if provider, ok := retriever.(session.Provider); ok {
+		return provider, nil
+	}
+	return session.NewCredentialsProvider(retriever), nil
+}
+
 // registerHandler adds an instrumented version of the provided handler to the
 // default mux at the indicated path.
 func registerHandler(path string, handler http.Handler) {
@@ -0,0 +1,70 @@
+// Command encrypt_secrets encrypts a bmc_exporter secrets file so it can be
+// stored on disk without exposing BMC passwords. The plaintext is read from
+// stdin and the encrypted file written to stdout. With --decrypt, the reverse
+// happens, allowing an encrypted file to be edited.
+//
+// A suitable key can be generated with `openssl rand -base64 32`.
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+
+	"github.com/gebn/bmc_exporter/session/file"
+
+	"github.com/alecthomas/kingpin"
+)
+
+var (
+	key = kingpin.Flag("key", "Base64-encoded 256-bit key. Prefer setting "+
+		"the BMC_EXPORTER_SECRETS_KEY environment variable or --key-file to "+
+		"passing this on the command line.").
+		Envar("BMC_EXPORTER_SECRETS_KEY").
+		String()
+	keyFile = kingpin.Flag("key-file", "File containing the base64-encoded "+
+		"key. Takes precedence over --key.").
+		String()
+	decrypt = kingpin.Flag("decrypt", "Decrypt stdin rather than "+
+		"encrypting it.").
+		Short('d').
+		Bool()
+)
+
+func main() {
+	log.SetFlags(0)
+	kingpin.Parse()
+
+	encoded := *key
+	if *keyFile != "" {
+		b, err := os.ReadFile(*keyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		encoded = string(b)
+	}
+	if encoded == "" {
+		log.Fatal("a key must be provided")
+	}
+	k, err := file.ParseKey(encoded)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	in, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var out []byte
+	if *decrypt {
+		out, err = file.Decrypt(k, in)
+	} else {
+		out, err = file.Encrypt(k, in)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := os.Stdout.Write(out); err != nil {
+		log.Fatal(err)
+	}
+}
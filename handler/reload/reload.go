@@ -0,0 +1,26 @@
+// Package reload implements the handler for /-/reload. Like Prometheus, a POST
+// or PUT to this endpoint causes the exporter to re-read its config.
+package reload
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Handler returns a handler that calls the supplied function when invoked,
+// returning a 500 if it fails. Other methods are rejected to avoid a reload
+// being triggered by a browser or crawler.
+func Handler(reload func() error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			w.Header().Set("Allow", "POST, PUT")
+			http.Error(w, "only POST or PUT requests are allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reload(); err != nil {
+			http.Error(w, fmt.Sprintf("failed to reload config: %v", err),
+				http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,213 @@
+// Package broker implements a credentials retriever that asks an HTTP(S)
+// service for each BMC's credentials. This allows the exporter to be plugged
+// into an in-house secret broker or CMDB without a bespoke provider.
+//
+// The broker is sent a GET request for each target, and must respond with a
+// 200 and a JSON object containing "username" and "password" keys, or a 404 if
+// it does not know the target.
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gebn/bmc_exporter/session"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	namespace = "bmc"
+	subsystem = "provider"
+
+	requests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "broker_requests_total",
+		Help:      "The number of HTTP requests made to the credential broker, including retries.",
+	})
+	requestFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "broker_request_failures_total",
+		Help: "The number of HTTP requests to the credential broker that " +
+			"did not produce a usable response. 404s are not failures.",
+	})
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "broker_request_duration_seconds",
+		Help:      "Observes the time taken by each HTTP request to the credential broker.",
+	})
+)
+
+// addrPlaceholder is replaced with the query-escaped target addr in the URL.
+const addrPlaceholder = "{addr}"
+
+// Config contains the parameters of a Provider. Only URL is required.
+type Config struct {
+
+	// URL is the endpoint to request, with "{addr}" standing in for the target
+	// addr, e.g. https://broker.example.com/bmc?target={addr}.
+	URL string
+
+	// BearerTokenFile is the path of a file containing a token to send in the
+	// Authorization header. It is re-read on Reload(). Leave empty to send no
+	// Authorization header.
+	BearerTokenFile string
+
+	// Retries is the maximum number of times to retry a request that failed
+	// for a transient reason, e.g. a 5xx or network error. Zero disables
+	// retries.
+	Retries uint64
+
+	// NegativeTTL is how long to remember that the broker does not know a
+	// target, avoiding a request every scrape for BMCs that have not been
+	// added yet. Zero disables negative caching.
+	NegativeTTL time.Duration
+
+	// Client is used to make requests. Its timeout bounds each attempt, and
+	// its transport's TLS config can be used to present a client certificate
+	// for mTLS. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Provider implements session.CredentialsRetriever using an HTTP credential
+// broker. It also implements session.Provider via
+// session.NewCredentialsProvider().
+type Provider struct {
+	session.Provider
+
+	config Config
+
+	// token is the current bearer token, or empty if none is configured.
+	token atomic.Pointer[string]
+
+	// missing remembers which addrs the broker did not know. It wraps
+	// request(), and is consulted by Credentials().
+	missing *session.CachingRetriever
+}
+
+// response is the body the broker is expected to return.
+type response struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+}
+
+// New validates the config and creates a Provider from it. It does not contact
+// the broker.
+func New(c Config) (*Provider, error) {
+	if c.URL == "" {
+		return nil, errors.New("broker URL must be specified")
+	}
+	if _, err := url.Parse(strings.ReplaceAll(c.URL, addrPlaceholder, "x")); err != nil {
+		return nil, fmt.Errorf("invalid broker URL: %w", err)
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	p := &Provider{
+		config: c,
+	}
+	p.missing = session.NewCachingRetriever("broker",
+		session.RetrieverFunc(p.request), 0, c.NegativeTTL)
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	p.Provider = session.NewCredentialsProvider(p)
+	return p, nil
+}
+
+// Reload re-reads the bearer token file, if any, and forgets which targets
+// the broker did not know, so they are asked about again on next use. If the
+// token file cannot be read, the previous token continues to be used.
+func (p *Provider) Reload() error {
+	token := ""
+	if p.config.BearerTokenFile != "" {
+		b, err := os.ReadFile(p.config.BearerTokenFile)
+		if err != nil {
+			return err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	p.token.Store(&token)
+	return p.missing.Reload()
+}
+
+// Credentials asks the broker for the credentials of the BMC at the supplied
+// addr. If the broker recently said it did not know the addr,
+// session.ErrCredentialNotFound is returned without contacting it.
+func (p *Provider) Credentials(ctx context.Context, addr string) (*session.Credentials, error) {
+	return p.missing.Credentials(ctx, addr)
+}
+
+// request queries the broker, retrying transient errors with exponential
+// back-off until the context expires or we run out of retries.
+func (p *Provider) request(ctx context.Context, addr string) (*session.Credentials, error) {
+	u := strings.ReplaceAll(p.config.URL, addrPlaceholder, url.QueryEscape(addr))
+	var creds *session.Credentials
+	attempt := func() error {
+		requests.Inc()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Accept", "application/json")
+		if token := *p.token.Load(); token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		timer := prometheus.NewTimer(requestDuration)
+		rsp, err := p.config.Client.Do(req)
+		timer.ObserveDuration()
+		if err != nil {
+			requestFailures.Inc()
+			return err // likely transient
+		}
+		defer rsp.Body.Close()
+
+		switch {
+		case rsp.StatusCode == http.StatusNotFound:
+			return backoff.Permanent(session.ErrCredentialNotFound)
+		case rsp.StatusCode == http.StatusTooManyRequests ||
+			rsp.StatusCode >= 500:
+			requestFailures.Inc()
+			return fmt.Errorf("unexpected status: %v", rsp.Status)
+		case rsp.StatusCode != http.StatusOK:
+			requestFailures.Inc()
+			return backoff.Permanent(fmt.Errorf("unexpected status: %v",
+				rsp.Status))
+		}
+		body := response{}
+		if err := json.NewDecoder(rsp.Body).Decode(&body); err != nil {
+			requestFailures.Inc()
+			return backoff.Permanent(fmt.Errorf("invalid response: %w", err))
+		}
+		if body.Username == nil || body.Password == nil {
+			requestFailures.Inc()
+			return backoff.Permanent(errors.New("response is missing " +
+				"username or password"))
+		}
+		creds = &session.Credentials{
+			Username: *body.Username,
+			Password: []byte(*body.Password),
+		}
+		return nil
+	}
+	err := backoff.Retry(attempt, backoff.WithContext(
+		backoff.WithMaxRetries(backoff.NewExponentialBackOff(),
+			p.config.Retries), ctx))
+	if err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
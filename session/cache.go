@@ -0,0 +1,290 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	cacheHits = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "credential_cache_hits_total",
+			Help: "The number of credential lookups answered from a cache. " +
+				"The result label is found or not_found.",
+		},
+		[]string{"retriever", "result"},
+	)
+	cacheMisses = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "credential_cache_misses_total",
+			Help: "The number of credential lookups passed through a cache " +
+				"to the underlying retriever.",
+		},
+		[]string{"retriever"},
+	)
+	cacheEvictions = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "credential_cache_evictions_total",
+			Help: "The number of entries removed from a credential cache. " +
+				"The reason label is expired, invalidated or reload.",
+		},
+		[]string{"retriever", "reason"},
+	)
+	cacheStale = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "credential_cache_stale_total",
+			Help: "The number of times expired credentials were returned " +
+				"because the underlying retriever failed to refresh them.",
+		},
+		[]string{"retriever"},
+	)
+)
+
+// cacheEntry is the result of a lookup. creds is nil if the retriever did not
+// know the addr.
+type cacheEntry struct {
+	creds   *Credentials
+	expires time.Time
+}
+
+// RetrieverFunc allows an ordinary function to be used as a
+// CredentialsRetriever.
+type RetrieverFunc func(ctx context.Context, addr string) (*Credentials, error)
+
+// Credentials calls f(ctx, addr).
+func (f RetrieverFunc) Credentials(ctx context.Context, addr string) (*Credentials, error) {
+	return f(ctx, addr)
+}
+
+// LeaseRetriever is implemented by CredentialsRetrievers that know how long the
+// credentials they return remain valid, e.g. from a Vault lease.
+type LeaseRetriever interface {
+	CredentialsRetriever
+
+	// Lease returns the credentials for an addr, and how long they may be
+	// cached for. A non-positive duration means the retriever does not know.
+	Lease(ctx context.Context, addr string) (*Credentials, time.Duration, error)
+}
+
+// LeaseFunc allows an ordinary function to be used as a LeaseRetriever.
+type LeaseFunc func(ctx context.Context, addr string) (*Credentials, time.Duration, error)
+
+// Credentials calls f(ctx, addr), discarding the lease duration.
+func (f LeaseFunc) Credentials(ctx context.Context, addr string) (*Credentials, error) {
+	creds, _, err := f(ctx, addr)
+	return creds, err
+}
+
+// Lease calls f(ctx, addr).
+func (f LeaseFunc) Lease(ctx context.Context, addr string) (*Credentials, time.Duration, error) {
+	return f(ctx, addr)
+}
+
+// CachingRetriever wraps a CredentialsRetriever, caching credentials it
+// returns for a TTL, or their lease if it is a LeaseRetriever, and
+// ErrCredentialNotFound for a separate, usually shorter, TTL. Other errors are
+// not cached. Entries are invalidated when the
+// BMC rejects them. It also implements Provider via NewCredentialsProvider(),
+// and forwards Reload() and OnChange() to the wrapped retriever if it
+// implements them, so can be used in place of it.
+type CachingRetriever struct {
+	Provider
+
+	// StaleTTL is how long after expiry credentials may still be returned if
+	// the wrapped retriever fails to refresh them with an error other than
+	// ErrCredentialNotFound, e.g. because it cannot be reached. Zero disables
+	// this. It must be set before first use.
+	StaleTTL time.Duration
+
+	name        string
+	retriever   CredentialsRetriever
+	ttl         time.Duration
+	negativeTTL time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]cacheEntry
+	lastSweep time.Time
+}
+
+// NewCachingRetriever wraps a retriever in a cache. The name identifies the
+// cache in metrics. A TTL of zero disables caching of that kind of result.
+func NewCachingRetriever(name string, r CredentialsRetriever, ttl, negativeTTL time.Duration) *CachingRetriever {
+	c := &CachingRetriever{
+		name:        name,
+		retriever:   r,
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		entries:     map[string]cacheEntry{},
+		lastSweep:   time.Now(),
+	}
+	cacheHits.WithLabelValues(name, "found")
+	cacheHits.WithLabelValues(name, "not_found")
+	cacheMisses.WithLabelValues(name)
+	cacheStale.WithLabelValues(name)
+	for _, reason := range []string{"expired", "invalidated", "reload"} {
+		cacheEvictions.WithLabelValues(name, reason)
+	}
+	c.Provider = NewCredentialsProvider(c)
+	return c
+}
+
+// Credentials returns cached credentials for the addr if there is a valid
+// entry, otherwise it asks the wrapped retriever. If that fails and the
+// expired entry is within StaleTTL, the expired credentials are returned, as
+// they are more likely to be correct than not.
+func (c *CachingRetriever) Credentials(ctx context.Context, addr string) (*Credentials, error) {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[addr]
+	stale := false
+	if ok && !now.Before(entry.expires) {
+		if entry.creds != nil && now.Before(entry.expires.Add(c.StaleTTL)) {
+			// keep it in case the retriever fails
+			stale = true
+		} else {
+			delete(c.entries, addr)
+			cacheEvictions.WithLabelValues(c.name, "expired").Inc()
+		}
+		ok = false
+	}
+	c.mu.Unlock()
+	if ok {
+		if entry.creds == nil {
+			cacheHits.WithLabelValues(c.name, "not_found").Inc()
+			return nil, ErrCredentialNotFound
+		}
+		cacheHits.WithLabelValues(c.name, "found").Inc()
+		return entry.creds, nil
+	}
+
+	cacheMisses.WithLabelValues(c.name).Inc()
+	creds, ttl, err := c.retrieve(ctx, addr)
+	if stale {
+		if err != nil && !errors.Is(err, ErrCredentialNotFound) {
+			cacheStale.WithLabelValues(c.name).Inc()
+			return entry.creds, nil
+		}
+		c.expire(addr, entry)
+	}
+	switch {
+	case err == nil && ttl > 0:
+		c.store(addr, cacheEntry{
+			creds:   creds,
+			expires: now.Add(ttl),
+		})
+	case errors.Is(err, ErrCredentialNotFound) && c.negativeTTL > 0:
+		c.store(addr, cacheEntry{
+			expires: now.Add(c.negativeTTL),
+		})
+	}
+	return creds, err
+}
+
+// retrieve asks the wrapped retriever for an addr's credentials, returning
+// them along with how long they may be cached for.
+func (c *CachingRetriever) retrieve(ctx context.Context, addr string) (*Credentials, time.Duration, error) {
+	leaser, ok := c.retriever.(LeaseRetriever)
+	if !ok {
+		creds, err := c.retriever.Credentials(ctx, addr)
+		return creds, c.ttl, err
+	}
+	creds, ttl, err := leaser.Lease(ctx, addr)
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	return creds, ttl, err
+}
+
+// expire removes an expired entry, unless it has been replaced or removed
+// since it was looked up.
+func (c *CachingRetriever) expire(addr string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if current, ok := c.entries[addr]; ok && current == entry {
+		delete(c.entries, addr)
+		cacheEvictions.WithLabelValues(c.name, "expired").Inc()
+	}
+}
+
+// store adds an entry to the cache. Every so often, it also removes entries
+// that have expired and are too old to be returned stale, so addrs that are
+// no longer looked up do not accumulate.
+func (c *CachingRetriever) store(addr string, entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[addr] = entry
+	now := time.Now()
+	if now.Sub(c.lastSweep) < max(c.ttl, c.negativeTTL) {
+		return
+	}
+	for addr, entry := range c.entries {
+		if !now.Before(entry.expires.Add(c.StaleTTL)) ||
+			(entry.creds == nil && !now.Before(entry.expires)) {
+			delete(c.entries, addr)
+			cacheEvictions.WithLabelValues(c.name, "expired").Inc()
+		}
+	}
+	c.lastSweep = now
+}
+
+// Invalidate implements Invalidator, discarding any cached result for the
+// addr. It is forwarded to the wrapped retriever if it is also an
+// Invalidator.
+func (c *CachingRetriever) Invalidate(addr string) {
+	c.mu.Lock()
+	if _, ok := c.entries[addr]; ok {
+		delete(c.entries, addr)
+		cacheEvictions.WithLabelValues(c.name, "invalidated").Inc()
+	}
+	c.mu.Unlock()
+	if invalidator, ok := c.retriever.(Invalidator); ok {
+		invalidator.Invalidate(addr)
+	}
+}
+
+// Reload empties the cache, then reloads the wrapped retriever if it is a
+// Reloader.
+func (c *CachingRetriever) Reload() error {
+	c.mu.Lock()
+	cacheEvictions.WithLabelValues(c.name, "reload").Add(float64(len(c.entries)))
+	c.entries = map[string]cacheEntry{}
+	c.mu.Unlock()
+	if reloader, ok := c.retriever.(Reloader); ok {
+		return reloader.Reload()
+	}
+	return nil
+}
+
+// OnChange subscribes the function to changes in the wrapped retriever, if it
+// is a ChangeNotifier. Cached entries for changed addrs are discarded before
+// the function is called, so new sessions use the new credentials.
+func (c *CachingRetriever) OnChange(fn func(changed func(addr string) bool)) {
+	notifier, ok := c.retriever.(ChangeNotifier)
+	if !ok {
+		return
+	}
+	notifier.OnChange(func(changed func(addr string) bool) {
+		c.mu.Lock()
+		for addr := range c.entries {
+			if changed(addr) {
+				delete(c.entries, addr)
+				cacheEvictions.WithLabelValues(c.name, "invalidated").Inc()
+			}
+		}
+		c.mu.Unlock()
+		fn(changed)
+	})
+}
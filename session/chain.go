@@ -0,0 +1,119 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	chainServed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chain_served_total",
+			Help: "The number of credential lookups answered by each " +
+				"member of the provider chain.",
+		},
+		[]string{"provider"},
+	)
+	chainFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "chain_failures_total",
+			Help: "The number of credential lookups that failed at each " +
+				"member of the provider chain, for a reason other than it " +
+				"not knowing the target. These stop the chain.",
+		},
+		[]string{"provider"},
+	)
+)
+
+// ChainLink is a named member of a Chain. The name is used in errors and
+// metrics.
+type ChainLink struct {
+	Name      string
+	Retriever CredentialsRetriever
+}
+
+// Chain implements CredentialsRetriever by asking several retrievers in order,
+// returning the credentials from the first that knows the addr. Retrievers
+// indicate they do not know an addr by returning ErrCredentialNotFound; any
+// other error is returned immediately, as falling through to a less specific
+// retriever when, say, Vault is down would try the wrong credentials. It also
+// implements Provider via NewCredentialsProvider(), Reloader, Invalidator and
+// ChangeNotifier, forwarding the latter three to members that implement them.
+type Chain struct {
+	Provider
+
+	links []ChainLink
+}
+
+// NewChain creates a chain from retrievers in descending order of precedence.
+func NewChain(links []ChainLink) *Chain {
+	c := &Chain{
+		links: links,
+	}
+	for _, link := range links {
+		chainServed.WithLabelValues(link.Name)
+		chainFailures.WithLabelValues(link.Name)
+	}
+	c.Provider = NewCredentialsProvider(c)
+	return c
+}
+
+// Credentials returns the credentials from the first retriever that knows the
+// addr, or ErrCredentialNotFound if none do.
+func (c *Chain) Credentials(ctx context.Context, addr string) (*Credentials, error) {
+	for _, link := range c.links {
+		creds, err := link.Retriever.Credentials(ctx, addr)
+		if errors.Is(err, ErrCredentialNotFound) {
+			continue
+		}
+		if err != nil {
+			chainFailures.WithLabelValues(link.Name).Inc()
+			return nil, fmt.Errorf("%v: %w", link.Name, err)
+		}
+		chainServed.WithLabelValues(link.Name).Inc()
+		return creds, nil
+	}
+	return nil, ErrCredentialNotFound
+}
+
+// Reload reloads every member that implements Reloader. All members are
+// reloaded even if one fails, and all errors are returned.
+func (c *Chain) Reload() error {
+	errs := []error{}
+	for _, link := range c.links {
+		if reloader, ok := link.Retriever.(Reloader); ok {
+			if err := reloader.Reload(); err != nil {
+				errs = append(errs, fmt.Errorf("%v: %w", link.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Invalidate implements Invalidator, forwarding to every member that
+// implements it. As we do not know which member served the addr, all are told.
+func (c *Chain) Invalidate(addr string) {
+	for _, link := range c.links {
+		if invalidator, ok := link.Retriever.(Invalidator); ok {
+			invalidator.Invalidate(addr)
+		}
+	}
+}
+
+// OnChange subscribes the function to changes in every member that implements
+// ChangeNotifier.
+func (c *Chain) OnChange(fn func(changed func(addr string) bool)) {
+	for _, link := range c.links {
+		if notifier, ok := link.Retriever.(ChangeNotifier); ok {
+			notifier.OnChange(fn)
+		}
+	}
+}
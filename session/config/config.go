@@ -0,0 +1,163 @@
+// Package config builds a session provider from a YAML config file, allowing
+// several credential stores to be chained together, e.g. a local file, then
+// Vault, then a file containing a default account. Provider types are looked
+// up in a registry, which contains all providers bundled with the exporter,
+// and can be extended with Register().
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gebn/bmc_exporter/session"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Factory creates a credentials retriever from the type-specific part of its
+// config, which should be decoded with Decode(). The context is cancelled when
+// the exporter shuts down, so can be used to stop background goroutines. If
+// the retriever implements session.Reloader or session.ChangeNotifier, these
+// will be used.
+type Factory func(ctx context.Context, config *yaml.Node) (session.CredentialsRetriever, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = map[string]Factory{}
+)
+
+// Register makes a provider type available for use in config files. It is
+// intended to be called from an init() function, and panics if the type has
+// already been registered.
+func Register(typ string, factory Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	if _, ok := factories[typ]; ok {
+		panic(fmt.Sprintf("provider type %v registered twice", typ))
+	}
+	factories[typ] = factory
+}
+
+// Types returns the names of all registered provider types, in alphabetical
+// order.
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// File is the top-level structure of the config file.
+type File struct {
+
+	// Providers are tried in order for each target, until one knows it.
+	Providers []Provider `yaml:"providers"`
+}
+
+// Provider is a single member of the chain.
+type Provider struct {
+
+	// Type is the registered name of the provider, e.g. static or vault.
+	Type string `yaml:"type"`
+
+	// Name identifies the provider in logs and metrics. It must be unique,
+	// and defaults to Type.
+	Name string `yaml:"name"`
+
+	// Config is passed to the type's factory.
+	Config yaml.Node `yaml:"config"`
+
+	// Cache optionally wraps the provider in a session.CachingRetriever.
+	Cache *Cache `yaml:"cache"`
+}
+
+// Cache configures caching of a provider's results. A zero TTL disables
+// caching of that kind of result.
+type Cache struct {
+
+	// TTL is how long to cache credentials for.
+	TTL time.Duration `yaml:"ttl"`
+
+	// NegativeTTL is how long to remember that the provider did not know a
+	// target.
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+}
+
+// Load reads the config file at the supplied path, and creates each provider
+// it lists, returning them as a chain.
+func Load(ctx context.Context, path string) (*session.Chain, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	d := yaml.NewDecoder(f)
+	d.KnownFields(true)
+	file := File{}
+	if err := d.Decode(&file); err != nil {
+		return nil, fmt.Errorf("%v: %w", path, err)
+	}
+	if len(file.Providers) == 0 {
+		return nil, fmt.Errorf("%v: at least one provider is required", path)
+	}
+
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+	links := make([]session.ChainLink, 0, len(file.Providers))
+	names := map[string]bool{}
+	for _, p := range file.Providers {
+		factory, ok := factories[p.Type]
+		if !ok {
+			return nil, fmt.Errorf("%v: unknown provider type %q", path,
+				p.Type)
+		}
+		name := p.Name
+		if name == "" {
+			name = p.Type
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%v: duplicate provider name %q; set "+
+				"name to distinguish providers of the same type", path, name)
+		}
+		names[name] = true
+		retriever, err := factory(ctx, &p.Config)
+		if err != nil {
+			return nil, fmt.Errorf("%v: provider %v: %w", path, name, err)
+		}
+		if p.Cache != nil {
+			retriever = session.NewCachingRetriever(name, retriever,
+				p.Cache.TTL, p.Cache.NegativeTTL)
+		}
+		links = append(links, session.ChainLink{
+			Name:      name,
+			Retriever: retriever,
+		})
+	}
+	return session.NewChain(links), nil
+}
+
+// Decode unmarshals a provider's config into a struct, rejecting unknown
+// fields. It does nothing if the config was omitted.
+func Decode(config *yaml.Node, v interface{}) error {
+	if config.Kind == 0 {
+		return nil
+	}
+	// yaml.Node.Decode() does not support KnownFields, so go the long way
+	b, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	return d.Decode(v)
+}
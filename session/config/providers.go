@@ -0,0 +1,313 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gebn/bmc_exporter/session"
+	"github.com/gebn/bmc_exporter/session/broker"
+	"github.com/gebn/bmc_exporter/session/directory"
+	"github.com/gebn/bmc_exporter/session/file"
+	"github.com/gebn/bmc_exporter/session/helper"
+	"github.com/gebn/bmc_exporter/session/vault"
+
+	"gopkg.in/yaml.v3"
+)
+
+func init() {
+	Register("static", newStatic)
+	Register("directory", newDirectory)
+	Register("vault", newVault)
+	Register("broker", newBroker)
+	Register("helper", newHelper)
+}
+
+// Static is the config of a file provider.
+type Static struct {
+	Path           string        `yaml:"path"`
+	KeyFile        string        `yaml:"key_file"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+
+	// Key is the base64-encoded key to decrypt the file with if it is
+	// encrypted and KeyFile is not set. It cannot be set in the config file,
+	// so defaults to the BMC_EXPORTER_SECRETS_KEY environment variable.
+	Key string `yaml:"-"`
+}
+
+func newStatic(ctx context.Context, node *yaml.Node) (session.CredentialsRetriever, error) {
+	c := Static{
+		ReloadInterval: time.Second * 30,
+		Key:            os.Getenv("BMC_EXPORTER_SECRETS_KEY"),
+	}
+	if err := Decode(node, &c); err != nil {
+		return nil, err
+	}
+	return c.New(ctx)
+}
+
+// New creates the provider. If ReloadInterval is positive, the file is
+// watched for changes until the context is cancelled.
+func (c *Static) New(ctx context.Context) (session.CredentialsRetriever, error) {
+	if c.Path == "" {
+		return nil, errors.New("path must be specified")
+	}
+	encoded := c.Key
+	if c.KeyFile != "" {
+		b, err := os.ReadFile(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+	}
+	var key []byte
+	if encoded != "" {
+		var err error
+		if key, err = file.ParseKey(encoded); err != nil {
+			return nil, err
+		}
+	}
+	provider, err := file.New(c.Path, key)
+	if err != nil {
+		return nil, err
+	}
+	if c.ReloadInterval > 0 {
+		go provider.Watch(ctx, c.ReloadInterval)
+	}
+	return provider, nil
+}
+
+// Directory is the config of a directory provider.
+type Directory struct {
+	Path           string        `yaml:"path"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+func newDirectory(ctx context.Context, node *yaml.Node) (session.CredentialsRetriever, error) {
+	c := Directory{
+		ReloadInterval: time.Second * 30,
+	}
+	if err := Decode(node, &c); err != nil {
+		return nil, err
+	}
+	return c.New(ctx)
+}
+
+// New creates the provider. If ReloadInterval is positive, the directory is
+// watched for changes until the context is cancelled.
+func (c *Directory) New(ctx context.Context) (session.CredentialsRetriever, error) {
+	if c.Path == "" {
+		return nil, errors.New("path must be specified")
+	}
+	provider, err := directory.New(c.Path)
+	if err != nil {
+		return nil, err
+	}
+	if c.ReloadInterval > 0 {
+		go provider.Watch(ctx, c.ReloadInterval)
+	}
+	return provider, nil
+}
+
+// Vault is the config of a Vault provider. Address defaults to the VAULT_ADDR
+// environment variable.
+type Vault struct {
+	Address      string        `yaml:"address"`
+	Namespace    string        `yaml:"namespace"`
+	CAFile       string        `yaml:"ca_file"`
+	TokenFile    string        `yaml:"token_file"`
+	RoleID       string        `yaml:"role_id"`
+	SecretIDFile string        `yaml:"secret_id_file"`
+	AppRoleMount string        `yaml:"approle_mount"`
+	Mount        string        `yaml:"mount"`
+	Path         string        `yaml:"path"`
+	UsernameKey  string        `yaml:"username_key"`
+	PasswordKey  string        `yaml:"password_key"`
+	CacheTTL     time.Duration `yaml:"cache_ttl"`
+	Retries      uint64        `yaml:"retries"`
+	Timeout      time.Duration `yaml:"timeout"`
+
+	// Token is used if neither TokenFile nor RoleID is set. It cannot be set
+	// in the config file, so defaults to the VAULT_TOKEN environment variable.
+	Token string `yaml:"-"`
+}
+
+func newVault(ctx context.Context, node *yaml.Node) (session.CredentialsRetriever, error) {
+	c := Vault{
+		Address: os.Getenv("VAULT_ADDR"),
+		Path:    "bmc/{addr}",
+		Timeout: time.Second * 5,
+		Retries: 3,
+		Token:   os.Getenv("VAULT_TOKEN"),
+	}
+	if err := Decode(node, &c); err != nil {
+		return nil, err
+	}
+	return c.New(ctx)
+}
+
+// New creates the provider.
+func (c *Vault) New(_ context.Context) (session.CredentialsRetriever, error) {
+	client, err := HTTPClient(c.Timeout, c.CAFile, "", "")
+	if err != nil {
+		return nil, err
+	}
+	token := ""
+	switch {
+	case c.TokenFile != "":
+		if token, err = readSecret(c.TokenFile); err != nil {
+			return nil, err
+		}
+	case c.RoleID == "":
+		// AppRole takes precedence over an ambient token
+		token = c.Token
+	}
+	provider, err := vault.New(vault.Config{
+		Address:      c.Address,
+		Namespace:    c.Namespace,
+		Mount:        c.Mount,
+		PathTemplate: c.Path,
+		UsernameKey:  c.UsernameKey,
+		PasswordKey:  c.PasswordKey,
+		Token:        token,
+		RoleID:       c.RoleID,
+		SecretIDFile: c.SecretIDFile,
+		AppRoleMount: c.AppRoleMount,
+		TTL:          c.CacheTTL,
+		Retries:      c.Retries,
+		Client:       client,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Broker is the config of an HTTP credential broker provider.
+type Broker struct {
+	URL              string        `yaml:"url"`
+	BearerTokenFile  string        `yaml:"bearer_token_file"`
+	CAFile           string        `yaml:"ca_file"`
+	CertFile         string        `yaml:"cert_file"`
+	KeyFile          string        `yaml:"key_file"`
+	Timeout          time.Duration `yaml:"timeout"`
+	Retries          uint64        `yaml:"retries"`
+	NegativeCacheTTL time.Duration `yaml:"negative_cache_ttl"`
+}
+
+func newBroker(ctx context.Context, node *yaml.Node) (session.CredentialsRetriever, error) {
+	c := Broker{
+		Timeout:          time.Second * 2,
+		Retries:          3,
+		NegativeCacheTTL: time.Minute,
+	}
+	if err := Decode(node, &c); err != nil {
+		return nil, err
+	}
+	return c.New(ctx)
+}
+
+// New creates the provider.
+func (c *Broker) New(_ context.Context) (session.CredentialsRetriever, error) {
+	client, err := HTTPClient(c.Timeout, c.CAFile, c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := broker.New(broker.Config{
+		URL:             c.URL,
+		BearerTokenFile: c.BearerTokenFile,
+		Retries:         c.Retries,
+		NegativeTTL:     c.NegativeCacheTTL,
+		Client:          client,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// Helper is the config of a credential helper provider.
+type Helper struct {
+	Command  []string      `yaml:"command"`
+	Stdin    bool          `yaml:"stdin"`
+	Timeout  time.Duration `yaml:"timeout"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+}
+
+func newHelper(ctx context.Context, node *yaml.Node) (session.CredentialsRetriever, error) {
+	c := Helper{
+		CacheTTL: time.Minute * 5,
+	}
+	if err := Decode(node, &c); err != nil {
+		return nil, err
+	}
+	return c.New(ctx)
+}
+
+// New creates the provider.
+func (c *Helper) New(_ context.Context) (session.CredentialsRetriever, error) {
+	provider, err := helper.New(helper.Config{
+		Command: c.Command,
+		Stdin:   c.Stdin,
+		Timeout: c.Timeout,
+		TTL:     c.CacheTTL,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return provider, nil
+}
+
+// readSecret returns the contents of a file without surrounding whitespace.
+func readSecret(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// HTTPClient creates a client for talking to a remote credential store. The CA
+// file, and the client certificate and key files, are optional, however the
+// certificate and key must be specified together.
+func HTTPClient(timeout time.Duration, caFile, certFile, keyFile string) (*http.Client, error) {
+	if (certFile == "") != (keyFile == "") {
+		return nil, errors.New("client certificate and key files must be " +
+			"specified together")
+	}
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	if caFile == "" && certFile == "" {
+		return client, nil
+	}
+	config := &tls.Config{}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v", caFile)
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	client.Transport = transport
+	return client, nil
+}
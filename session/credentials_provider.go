@@ -1,9 +1,14 @@
 package session
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"slices"
+	"strings"
+	"sync"
 
 	"github.com/gebn/bmc"
 	"github.com/gebn/bmc/pkg/ipmi"
@@ -22,8 +27,8 @@ const (
 var (
 	// ErrCredentialNotFound is returned when a CredentialsRetriever can
 	// confidently say it does not know of the BMC, or has no credentials for
-	// it. This is provided for convenience; no branching is done based on this
-	// value being returned.
+	// it. Chain relies on this to move on to the next retriever; any other
+	// error stops the chain.
 	ErrCredentialNotFound = errors.New("no credential found for addr")
 
 	credentialFailures = promauto.NewCounter(prometheus.CounterOpts{
@@ -41,6 +46,20 @@ var (
 			"credential for the target is unknown. Less than or equal to the " +
 			"total number of credential provider failures.",
 	})
+	credentialFallbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "credential_fallbacks_total",
+		Help: "The number of times the BMC rejected a candidate credential, " +
+			"and we moved on to the next one.",
+	})
+	fallbackCredentialsInUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "fallback_credentials_in_use",
+		Help: "The number of targets whose last successful session used " +
+			"a credential other than the first candidate.",
+	})
 )
 
 // Credentials represents a username and password pair, giving access to a BMC.
@@ -58,6 +77,120 @@ type Credentials struct {
 	// This is called K_[UID] in the spec ("the key for the user with ID
 	// 'UID'").
 	Password []byte
+
+	// MaxPrivilegeLevel is the highest privilege level the session will be
+	// able to use. The default (zero) value, ipmi.PrivilegeLevelHighest, is
+	// not supported by all BMCs and violates least privilege, so is replaced
+	// with ipmi.PrivilegeLevelUser, which is sufficient for most BMCs. Some
+	// require Operator to read DCMI power draw.
+	MaxPrivilegeLevel ipmi.PrivilegeLevel
+
+	// CipherSuites is the list of cipher suites to use, in descending order of
+	// preference. If empty, the bmc library's defaults are used.
+	CipherSuites []ipmi.CipherSuite
+
+	// KG is the BMC key, used in the rare case the BMC has been configured to
+	// require one in addition to the user's password. Leave empty if unset.
+	KG []byte
+
+	// Fallbacks are further credentials to try, in order, if the BMC rejects
+	// these ones, e.g. because it is part-way through a password rotation.
+	// Once a candidate works for a BMC, it is tried first for that BMC until
+	// it stops working. The Fallbacks field of each fallback is ignored.
+	Fallbacks []Credentials
+}
+
+// Equal returns whether two sets of credentials, including their session
+// parameters and any fallbacks, are identical.
+func (c *Credentials) Equal(o *Credentials) bool {
+	if c.Username != o.Username || !bytes.Equal(c.Password, o.Password) ||
+		c.MaxPrivilegeLevel != o.MaxPrivilegeLevel ||
+		!slices.Equal(c.CipherSuites, o.CipherSuites) ||
+		!bytes.Equal(c.KG, o.KG) ||
+		len(c.Fallbacks) != len(o.Fallbacks) {
+		return false
+	}
+	for i := range c.Fallbacks {
+		if !c.Fallbacks[i].Equal(&o.Fallbacks[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// candidates returns the credentials followed by their fallbacks.
+func (c *Credentials) candidates() []Credentials {
+	candidates := make([]Credentials, 0, len(c.Fallbacks)+1)
+	candidates = append(candidates, *c)
+	return append(candidates, c.Fallbacks...)
+}
+
+// key returns a string uniquely identifying the credentials and session
+// parameters, but not fallbacks, so a candidate can be recognised in a
+// reloaded list.
+func (c *Credentials) key() string {
+	return fmt.Sprintf("%s\x00%x\x00%d\x00%v\x00%x", c.Username, c.Password,
+		c.MaxPrivilegeLevel, c.CipherSuites, c.KG)
+}
+
+// sessionOpts returns the options to use to establish a session with these
+// credentials.
+func (c *Credentials) sessionOpts() *bmc.V2SessionOpts {
+	level := c.MaxPrivilegeLevel
+	if level == ipmi.PrivilegeLevelHighest {
+		level = ipmi.PrivilegeLevelUser
+	}
+	return &bmc.V2SessionOpts{
+		SessionOpts: bmc.SessionOpts{
+			Username:          c.Username,
+			Password:          c.Password,
+			MaxPrivilegeLevel: level,
+		},
+		KG:           c.KG,
+		CipherSuites: c.CipherSuites,
+	}
+}
+
+// IsAuthenticationFailure returns whether an error returned when establishing
+// a session indicates the BMC rejected the username, password or BMC key, as
+// opposed to, say, a timeout.
+func IsAuthenticationFailure(err error) bool {
+	if errors.Is(err, bmc.ErrIncorrectPassword) {
+		return true
+	}
+	if err == nil {
+		return false
+	}
+	// the library does not expose errors for the BMC not knowing the user, or
+	// using a different BMC key, only the status code in RAKP Message 2's
+	// error string, and a fixed prefix for RAKP Message 4's
+	msg := err.Error()
+	return strings.Contains(msg, ipmi.StatusCodeUnauthorisedName.String()) ||
+		strings.Contains(msg, "RAKP4 ICV fail")
+}
+
+// handshakeError wraps an error that occurred while dialling or establishing a
+// session with a BMC, after its credentials were retrieved.
+type handshakeError struct {
+	err error
+}
+
+func (e *handshakeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *handshakeError) Unwrap() error {
+	return e.err
+}
+
+// IsHandshakeFailure returns whether an error returned by a Provider occurred
+// while talking to the BMC, rather than while retrieving its credentials, e.g.
+// a timeout because the BMC is powered off. Only providers created with
+// NewCredentialsProvider() make this distinction; for others, it always
+// returns false.
+func IsHandshakeFailure(err error) bool {
+	h := &handshakeError{}
+	return errors.As(err, &h)
 }
 
 // CredentialsRetriever is implemented by things that can find the username and
@@ -72,19 +205,30 @@ type CredentialsRetriever interface {
 	Credentials(ctx context.Context, addr string) (*Credentials, error)
 }
 
-// NewCredentialsProvider creates a provider from a CredentialsRetriever.
+// NewCredentialsProvider creates a provider from a CredentialsRetriever. If the
+// retriever is a ChangeNotifier, it must be ready to accept subscriptions.
 func NewCredentialsProvider(r CredentialsRetriever) Provider {
-	return credentialsProvider{
+	c := &credentialsProvider{
 		CredentialsRetriever: r,
 	}
+	if notifier, ok := r.(ChangeNotifier); ok {
+		notifier.OnChange(c.forget)
+	}
+	return c
 }
 
 // credentialsProvider implements Provider using a CredentialsProvider.
 type credentialsProvider struct {
 	CredentialsRetriever
+
+	// learned maps addrs to the key of the candidate credential that last
+	// worked for them, if it was not the first candidate. Addrs using their
+	// first candidate are absent, so this only grows during rotations, and
+	// addrs are removed when their credentials change or are invalidated.
+	learned sync.Map
 }
 
-func (c credentialsProvider) Session(ctx context.Context, addr string) (bmc.Session, io.Closer, error) {
+func (c *credentialsProvider) Session(ctx context.Context, addr string) (bmc.Session, io.Closer, error) {
 	creds, err := c.CredentialsRetriever.Credentials(ctx, addr)
 	if err != nil {
 		credentialFailures.Inc()
@@ -93,20 +237,86 @@ func (c credentialsProvider) Session(ctx context.Context, addr string) (bmc.Sess
 		}
 		return nil, nil, err
 	}
-	machine, err := bmc.Dial(ctx, addr)
+	machine, err := bmc.DialV2(addr)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, &handshakeError{err}
+	}
+	candidates := c.order(addr, creds.candidates())
+	for i, candidate := range candidates {
+		if i > 0 {
+			credentialFallbacks.Inc()
+		}
+		var sess *bmc.V2Session
+		sess, err = machine.NewV2Session(ctx, candidate.sessionOpts())
+		if err == nil {
+			c.learn(addr, &candidate, candidate.key() == creds.key())
+			return sess, machine, nil
+		}
+		if !IsAuthenticationFailure(err) {
+			// no point trying other credentials if the BMC isn't responding
+			break
+		}
+	}
+	if IsAuthenticationFailure(err) {
+		// nothing works; start from the first candidate next time, and make
+		// sure they are fresh
+		c.Invalidate(addr)
+	}
+	machine.Close()
+	return nil, nil, &handshakeError{err}
+}
+
+// order moves the candidate that last worked for an addr, if any, to the front
+// of the list.
+func (c *credentialsProvider) order(addr string, candidates []Credentials) []Credentials {
+	key, ok := c.learned.Load(addr)
+	if !ok {
+		return candidates
+	}
+	for i := range candidates {
+		if candidates[i].key() == key.(string) {
+			learned := candidates[i]
+			copy(candidates[1:i+1], candidates[:i])
+			candidates[0] = learned
+			break
+		}
+	}
+	return candidates
+}
+
+// Invalidate implements Invalidator, forgetting which candidate last worked for
+// the addr. It is forwarded to the retriever if it is also an Invalidator.
+func (c *credentialsProvider) Invalidate(addr string) {
+	c.learn(addr, nil, true)
+	if invalidator, ok := c.CredentialsRetriever.(Invalidator); ok {
+		invalidator.Invalidate(addr)
 	}
-	sess, err := machine.NewSession(ctx, &bmc.SessionOpts{
-		Username:          creds.Username,
-		Password:          creds.Password,
-		MaxPrivilegeLevel: ipmi.PrivilegeLevelUser,
+}
+
+// forget removes the learned candidates of addrs whose credentials have
+// changed or been removed, as they may no longer be among the candidates, and
+// the addr may never be looked up again.
+func (c *credentialsProvider) forget(changed func(addr string) bool) {
+	c.learned.Range(func(addr, _ interface{}) bool {
+		if changed(addr.(string)) {
+			c.learn(addr.(string), nil, true)
+		}
+		return true
 	})
-	if err != nil {
-		machine.Close()
-		return nil, nil, err
+}
+
+// learn records the candidate that just worked for an addr. If first is true,
+// the candidate is not needed, and the addr is forgotten.
+func (c *credentialsProvider) learn(addr string, candidate *Credentials, first bool) {
+	if first {
+		if _, loaded := c.learned.LoadAndDelete(addr); loaded {
+			fallbackCredentialsInUse.Dec()
+		}
+		return
+	}
+	if _, loaded := c.learned.Swap(addr, candidate.key()); !loaded {
+		fallbackCredentialsInUse.Inc()
 	}
-	return sess, machine, nil
 }
 
 // TODO how do structs implement CredentialsProvider, while having a New()
@@ -0,0 +1,38 @@
+package session
+
+import (
+	"context"
+	"testing"
+)
+
+// notifyingRetriever is a ChangeNotifier that knows no addrs.
+type notifyingRetriever struct {
+	Notifier
+}
+
+func (*notifyingRetriever) Credentials(context.Context, string) (*Credentials, error) {
+	return nil, ErrCredentialNotFound
+}
+
+func TestCredentialsProviderForget(t *testing.T) {
+	r := &notifyingRetriever{}
+	c := NewCredentialsProvider(r).(*credentialsProvider)
+	fallback := &Credentials{Username: "fallback"}
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		c.learn(addr, fallback, false)
+	}
+
+	r.Notify(func(addr string) bool {
+		return addr == "10.0.0.1"
+	})
+	c.Invalidate("10.0.0.2")
+
+	learned := []string{}
+	c.learned.Range(func(addr, _ interface{}) bool {
+		learned = append(learned, addr.(string))
+		return true
+	})
+	if len(learned) != 1 || learned[0] != "10.0.0.3" {
+		t.Errorf("learned addrs = %v, want [10.0.0.3]", learned)
+	}
+}
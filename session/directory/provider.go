@@ -0,0 +1,258 @@
+// Package directory implements a session provider that reads credentials from
+// a directory tree, such as a Kubernetes Secret mounted as a volume.
+//
+// Each entry in the directory represents a target. An entry is either a YAML
+// file containing "username" and "password" keys, or a subdirectory containing
+// files named "username" and "password". Both may also specify a "target"; if
+// omitted, the entry's name is used. Secret keys cannot contain colons, so
+// names are also matched against the target with any port removed, e.g. an
+// entry named 192.0.2.1 will be used for 192.0.2.1:623.
+//
+// Entries whose names begin with a dot are ignored, which excludes kubelet's
+// "..data" symlink and timestamped directories. When "..data" is present, the
+// tree is read through it, so a single update is seen in its entirety.
+package directory
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gebn/bmc_exporter/session"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	namespace = "bmc"
+	subsystem = "provider"
+
+	lastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "directory_last_reload_successful",
+		Help: "Whether the most recent attempt to load the secrets " +
+			"directory succeeded.",
+	})
+	lastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "directory_last_reload_success_timestamp_seconds",
+		Help: "When the secrets directory was last successfully loaded, as " +
+			"seconds since the Unix Epoch.",
+	})
+	entries = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "directory_entries",
+		Help:      "The number of targets in the last successfully loaded secrets directory.",
+	})
+)
+
+// dataLink is the symlink kubelet atomically swaps to point at the latest
+// version of a Secret's contents.
+const dataLink = "..data"
+
+// Credentials is the format of an entry that is a file.
+type Credentials struct {
+	Target   string `yaml:"target"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// contents is the set of credentials read from a directory, keyed by target.
+// It is never modified once loaded.
+type contents map[string]session.Credentials
+
+// Lookup implements session.Table.
+func (c contents) Lookup(addr string) (session.Credentials, bool) {
+	return lookup(c, addr)
+}
+
+// Equal implements session.Table.
+func (c contents) Equal(other contents) bool {
+	return len(session.ChangedAddrs(c, other)) == 0 &&
+		len(session.ChangedAddrs(other, c)) == 0
+}
+
+// Provider implements session.Provider using credentials read from a
+// directory. The directory can be re-read at any time with Reload(); lookups
+// in progress continue to use the previous contents. If the directory is a
+// Kubernetes Secret volume, Watch() only re-reads it when kubelet swaps the
+// "..data" symlink; otherwise it is re-read every interval, and subscribers
+// are only notified if something changed.
+type Provider struct {
+	session.Provider
+	*session.ReloadableTable[contents]
+
+	path string
+}
+
+// Credentials returns the credentials for the entry matching the supplied
+// addr, or session.ErrCredentialNotFound if there is none.
+func (p *Provider) Credentials(ctx context.Context, addr string) (*session.Credentials, error) {
+	creds, ok := p.Current().Lookup(addr)
+	if !ok {
+		return nil, session.ErrCredentialNotFound
+	}
+	return &creds, nil
+}
+
+// New creates a provider from the directory at the supplied path. An error is
+// returned if it cannot be read, or contains an invalid entry.
+func New(path string) (*Provider, error) {
+	p := &Provider{
+		path: path,
+	}
+	table, err := session.NewReloadableTable(path, p.load, p.version,
+		session.ReloadMetrics{
+			LastReloadSuccessful:       lastReloadSuccessful,
+			LastReloadSuccessTimestamp: lastReloadSuccessTimestamp,
+		})
+	if err != nil {
+		return nil, err
+	}
+	p.ReloadableTable = table
+	p.Provider = session.NewCredentialsProvider(p)
+	return p, nil
+}
+
+// load implements session.LoadFunc, with the destination of the "..data"
+// symlink as its version.
+func (p *Provider) load() (contents, string, error) {
+	version, _ := p.version()
+	creds, err := load(p.path, version)
+	if err != nil {
+		return nil, "", err
+	}
+	entries.Set(float64(len(creds)))
+	return creds, version, nil
+}
+
+// version implements session.VersionFunc. It returns an empty version if the
+// directory is not a Kubernetes Secret volume, so is re-read every time.
+func (p *Provider) version() (string, error) {
+	version, _ := os.Readlink(filepath.Join(p.path, dataLink))
+	return version, nil
+}
+
+// lookup finds the credentials for an addr, trying the addr as-is, then
+// without its port.
+func lookup(creds map[string]session.Credentials, addr string) (session.Credentials, bool) {
+	if c, ok := creds[addr]; ok {
+		return c, true
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		if c, ok := creds[strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")]; ok {
+			return c, true
+		}
+	}
+	return session.Credentials{}, false
+}
+
+// load reads every entry in a directory. If version is non-empty, it is the
+// destination of the "..data" symlink, and is read instead of the top-level
+// symlinks, so all entries come from the same version of the Secret.
+func load(path, version string) (map[string]session.Credentials, error) {
+	root := path
+	if version != "" {
+		if filepath.IsAbs(version) {
+			root = version
+		} else {
+			root = filepath.Join(path, version)
+		}
+	}
+	dirents, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	creds := map[string]session.Credentials{}
+	for _, dirent := range dirents {
+		name := dirent.Name()
+		if strings.HasPrefix(name, ".") {
+			continue
+		}
+		entryPath := filepath.Join(root, name)
+		// stat rather than using the dirent, to follow symlinks
+		info, err := os.Stat(entryPath)
+		if err != nil {
+			return nil, err
+		}
+		var target string
+		var c session.Credentials
+		if info.IsDir() {
+			target, c, err = loadDir(entryPath)
+		} else {
+			target, c, err = loadFile(entryPath)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", name, err)
+		}
+		if target == "" {
+			target = name
+		}
+		if _, ok := creds[target]; ok {
+			return nil, fmt.Errorf("%v: duplicate target %v", name, target)
+		}
+		creds[target] = c
+	}
+	return creds, nil
+}
+
+// loadFile reads an entry consisting of a YAML file, returning its target, if
+// any, and credentials.
+func loadFile(path string) (string, session.Credentials, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", session.Credentials{}, err
+	}
+	d := yaml.NewDecoder(bytes.NewReader(b))
+	d.KnownFields(true)
+	c := Credentials{}
+	if err := d.Decode(&c); err != nil {
+		return "", session.Credentials{}, err
+	}
+	return c.Target, session.Credentials{
+		Username: c.Username,
+		Password: []byte(c.Password),
+	}, nil
+}
+
+// loadDir reads an entry consisting of a directory containing username,
+// password and optionally target files, returning its target, if any, and
+// credentials.
+func loadDir(path string) (string, session.Credentials, error) {
+	username, err := readValue(filepath.Join(path, "username"))
+	if err != nil {
+		return "", session.Credentials{}, err
+	}
+	password, err := readValue(filepath.Join(path, "password"))
+	if err != nil {
+		return "", session.Credentials{}, err
+	}
+	target, err := readValue(filepath.Join(path, "target"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", session.Credentials{}, err
+	}
+	return string(target), session.Credentials{
+		Username: string(username),
+		Password: password,
+	}, nil
+}
+
+// readValue reads a file, removing a single trailing newline, as is often
+// added when creating Secrets from files.
+func readValue(path string) ([]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r")), nil
+}
@@ -0,0 +1,112 @@
+package file
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// pemType is the type of PEM block containing an encrypted secrets file.
+	pemType = "BMC EXPORTER SECRETS"
+
+	// cipherHeader names the algorithm used to encrypt the block, leaving
+	// room for others in future.
+	cipherHeader = "Cipher"
+	cipherAESGCM = "AES-256-GCM"
+
+	// KeySize is the length of the key used to encrypt secrets files, in
+	// bytes.
+	KeySize = 32
+)
+
+// ParseKey decodes a base64-encoded encryption key, as held in the key file or
+// environment variable. Surrounding whitespace is ignored.
+func ParseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %v bytes, got %v", KeySize,
+			len(key))
+	}
+	return key, nil
+}
+
+// Encrypt seals a plaintext secrets file with AES-256-GCM, returning a PEM
+// block that can be written to disk in its place.
+func Encrypt(key, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: pemType,
+		Headers: map[string]string{
+			cipherHeader: cipherAESGCM,
+		},
+		Bytes: aead.Seal(nonce, nonce, plaintext, []byte(pemType)),
+	}), nil
+}
+
+// isEncrypted returns whether the contents of a secrets file appear to be
+// encrypted.
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data),
+		[]byte("-----BEGIN "+pemType+"-----"))
+}
+
+// Decrypt reverses Encrypt(). The plaintext is only held in memory.
+func Decrypt(key, data []byte) ([]byte, error) {
+	if key == nil {
+		return nil, errors.New("secrets file is encrypted, but no key was " +
+			"provided")
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != pemType {
+		return nil, errors.New("secrets file is not a valid PEM block")
+	}
+	if c := block.Headers[cipherHeader]; c != cipherAESGCM {
+		return nil, fmt.Errorf("unsupported cipher %q", c)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(block.Bytes) < aead.NonceSize() {
+		return nil, errors.New("secrets file is truncated")
+	}
+	nonce, ciphertext := block.Bytes[:aead.NonceSize()],
+		block.Bytes[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, []byte(pemType))
+	if err != nil {
+		// deliberately vague; GCM does not distinguish a wrong key from a
+		// corrupted file
+		return nil, errors.New("failed to decrypt secrets file; is the key " +
+			"correct?")
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %v bytes, got %v", KeySize,
+			len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
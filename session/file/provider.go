@@ -2,67 +2,281 @@
 // local config file.
 package file
 
-// TODO implement hot-reloading of the config file; it may be neater to do this
-// at a higher-level, e.g. a provider indicates to the exporter that it needs to
-// be reloaded, which can then replace the entire web server, rather than
-// locking on a map.
-
 import (
+	"bytes"
 	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gebn/bmc_exporter/session"
 
+	"github.com/gebn/bmc/pkg/ipmi"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"gopkg.in/yaml.v3"
 )
 
+var (
+	namespace = "bmc"
+	subsystem = "provider"
+
+	lastReloadSuccessful = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "file_last_reload_successful",
+		Help: "Whether the most recent attempt to load the secrets file " +
+			"succeeded.",
+	})
+	lastReloadSuccessTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "file_last_reload_success_timestamp_seconds",
+		Help: "When the secrets file was last successfully loaded, as " +
+			"seconds since the Unix Epoch.",
+	})
+	matches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "file_matches_total",
+			Help: "The number of credential lookups answered by each kind " +
+				"of secrets file entry. The rule label is the entry's key, " +
+				"except for exact matches, where it is empty.",
+		},
+		[]string{"kind", "rule"},
+	)
+)
+
 // Credentials represents the username and password for a single target in a
 // config file. N.B. this is not a generic credentials type; it is specific to
 // this particular provider's config format.
 type Credentials struct {
 	Username string `yaml:"username"`
 	Password string `yaml:"password"`
+
+	// Privilege is the maximum privilege level of the session: user,
+	// operator or administrator. Defaults to user.
+	Privilege string `yaml:"privilege"`
+
+	// CipherSuites are the IDs of the cipher suites to use, in descending
+	// order of preference, e.g. [17, 3]. Defaults to the bmc library's
+	// preference.
+	CipherSuites []ipmi.CipherSuiteID `yaml:"cipher_suites"`
+
+	// KG is the hex-encoded BMC key, if the BMC requires one.
+	KG string `yaml:"kg"`
+}
+
+// entry is the value of a key in the config file. It is usually a single set
+// of credentials, however it can also be a list of candidates to try in order,
+// which become the primary credentials' fallbacks.
+type entry session.Credentials
+
+// UnmarshalYAML allows an entry to be either a mapping or a sequence of them.
+func (e *entry) UnmarshalYAML(value *yaml.Node) error {
+	nodes := []*yaml.Node{value}
+	if value.Kind == yaml.SequenceNode {
+		if len(value.Content) == 0 {
+			return fmt.Errorf("line %v: at least one candidate is required",
+				value.Line)
+		}
+		nodes = value.Content
+	}
+	candidates := make([]session.Credentials, len(nodes))
+	for i, node := range nodes {
+		creds := Credentials{}
+		if err := decodeStrict(node, &creds); err != nil {
+			return err
+		}
+		converted, err := creds.sessionCredentials()
+		if err != nil {
+			return fmt.Errorf("line %v: %w", node.Line, err)
+		}
+		candidates[i] = converted
+	}
+	*e = entry(candidates[0])
+	if len(candidates) > 1 {
+		e.Fallbacks = candidates[1:]
+	}
+	return nil
+}
+
+// decodeStrict decodes a mapping node into a struct, returning an error if it
+// contains keys without a corresponding field. This is necessary as
+// yaml.Node.Decode() does not inherit the decoder's KnownFields setting, so
+// typos would otherwise be silently ignored inside custom unmarshalers.
+func decodeStrict(value *yaml.Node, v interface{}) error {
+	if value.Kind == yaml.MappingNode {
+		t := reflect.TypeOf(v).Elem()
+		known := make(map[string]bool, t.NumField())
+		for i := 0; i < t.NumField(); i++ {
+			name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+			known[name] = true
+		}
+		for i := 0; i < len(value.Content); i += 2 {
+			key := value.Content[i]
+			if !known[key.Value] {
+				return fmt.Errorf("line %v: field %v not found in type %v",
+					key.Line, key.Value, t)
+			}
+		}
+	}
+	return value.Decode(v)
+}
+
+// sessionCredentials validates the credentials and converts them into the
+// form used by the rest of the exporter.
+func (c *Credentials) sessionCredentials() (session.Credentials, error) {
+	creds := session.Credentials{
+		Username: c.Username,
+		Password: []byte(c.Password),
+	}
+	if c.Privilege != "" {
+		level, err := session.ParsePrivilegeLevel(c.Privilege)
+		if err != nil {
+			return session.Credentials{}, err
+		}
+		creds.MaxPrivilegeLevel = level
+	}
+	for _, id := range c.CipherSuites {
+		suite, err := session.CipherSuite(id)
+		if err != nil {
+			return session.Credentials{}, err
+		}
+		creds.CipherSuites = append(creds.CipherSuites, suite)
+	}
+	if c.KG != "" {
+		kg, err := hex.DecodeString(c.KG)
+		if err != nil {
+			return session.Credentials{}, fmt.Errorf("invalid kg: %w", err)
+		}
+		if len(kg) > 20 {
+			return session.Credentials{}, fmt.Errorf("kg is %v bytes, "+
+				"cannot be longer than 20", len(kg))
+		}
+		creds.KG = kg
+	}
+	return creds, nil
 }
 
+// Provider implements session.Provider using credentials loaded from a YAML
+// file. The file can be re-read at any time with Reload(); lookups in progress
+// continue to use the previous config, and new lookups see the new config as
+// soon as it has been parsed successfully. Watch() reloads the file whenever
+// its modification time changes. This follows symlinks, so also notices the
+// target being swapped out.
+//
+// Keys in the file are usually targets, however they can also be CIDR ranges
+// (e.g. 10.20.0.0/16), globs (e.g. bmc-*.example.com), or "default". An exact
+// match always wins, followed by the CIDR with the longest prefix, the glob
+// with the most literal characters, and finally the default entry. CIDRs and
+// globs are matched against the target with any port removed; globs are also
+// tried against the target as-is.
 type Provider struct {
 	session.Provider
+	*session.ReloadableTable[*table]
 
-	credentials map[string]session.Credentials
+	path string
+
+	// key decrypts the file if it is encrypted. It is nil if no key was
+	// provided, in which case only plaintext files can be loaded.
+	key []byte
 }
 
-func (p Provider) Credentials(ctx context.Context, addr string) (*session.Credentials, error) {
-	creds, ok := p.credentials[addr]
+func (p *Provider) Credentials(ctx context.Context, addr string) (*session.Credentials, error) {
+	creds, kind, key, ok := p.Current().lookup(addr)
 	if !ok {
 		return nil, session.ErrCredentialNotFound
 	}
+	matches.WithLabelValues(kind, key).Inc()
 	return &creds, nil
 }
 
-func New(path string) (*Provider, error) {
-	f, err := os.Open(path)
+// New creates a provider from the config file at the supplied path. If the
+// file is encrypted with Encrypt(), key is used to decrypt it; it may be nil if
+// the file is plaintext. An error is returned if the file cannot be read,
+// decrypted, or is invalid.
+func New(path string, key []byte) (*Provider, error) {
+	p := &Provider{
+		path: path,
+		key:  key,
+	}
+	table, err := session.NewReloadableTable(path, p.load, p.version,
+		session.ReloadMetrics{
+			LastReloadSuccessful:       lastReloadSuccessful,
+			LastReloadSuccessTimestamp: lastReloadSuccessTimestamp,
+		})
 	if err != nil {
 		return nil, err
 	}
+	p.ReloadableTable = table
+	p.Provider = session.NewCredentialsProvider(p)
+	return p, nil
+}
+
+// load implements session.LoadFunc, with the file's modification time as its
+// version.
+func (p *Provider) load() (*table, string, error) {
+	creds, modified, err := load(p.path, p.key)
+	if err != nil {
+		return nil, "", err
+	}
+	return newTable(creds), strconv.FormatInt(modified.UnixNano(), 10), nil
+}
+
+// version implements session.VersionFunc.
+func (p *Provider) version() (string, error) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(info.ModTime().UnixNano(), 10), nil
+}
+
+// load parses the config file at the supplied path, decrypting it with key if
+// necessary, returning its credentials and modification time.
+func load(path string, key []byte) (map[string]session.Credentials, time.Time, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
 	defer f.Close()
 
-	d := yaml.NewDecoder(f)
+	info, err := f.Stat()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if isEncrypted(data) {
+		data, err = Decrypt(key, data)
+		if err != nil {
+			return nil, time.Time{}, err
+		}
+		// best effort; copies will remain in the decoder's buffers
+		defer clear(data)
+	}
+
+	d := yaml.NewDecoder(bytes.NewReader(data))
 	d.KnownFields(true)
-	m := map[string]Credentials{}
+	m := map[string]entry{}
 	if err := d.Decode(&m); err != nil {
-		return nil, err
+		return nil, time.Time{}, err
 	}
 	// copying the map is unsatisfying, but the safest way; this code is not in
 	// the hot path
 	creds := make(map[string]session.Credentials, len(m))
-	for addr, cred := range m {
-		creds[addr] = session.Credentials{
-			Username: cred.Username,
-			Password: []byte(cred.Password),
-		}
+	for addr, e := range m {
+		creds[addr] = session.Credentials(e)
 	}
-	p := &Provider{
-		credentials: creds,
-	}
-	p.Provider = session.NewCredentialsProvider(p)
-	return p, nil
+	return creds, info.ModTime(), nil
 }
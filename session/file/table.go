@@ -0,0 +1,190 @@
+package file
+
+import (
+	"net"
+	"net/netip"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/gebn/bmc_exporter/session"
+)
+
+const (
+	// defaultKey is the key of the entry used when no other entry matches.
+	defaultKey = "default"
+
+	kindExact   = "exact"
+	kindCIDR    = "cidr"
+	kindGlob    = "glob"
+	kindDefault = "default"
+)
+
+// rule is a non-exact entry in the secrets file.
+type rule struct {
+
+	// key is the entry's key in the file, used to identify it in metrics.
+	key string
+
+	// prefix is set for CIDR rules.
+	prefix netip.Prefix
+
+	// specificity orders glob rules; it is the number of literal characters
+	// in the pattern.
+	specificity int
+
+	credentials session.Credentials
+}
+
+// table resolves addrs to credentials. Entries are tried from most to least
+// specific: exact matches, then CIDR ranges from longest to shortest prefix,
+// then globs from most to fewest literal characters, then the default entry.
+// It is immutable once built.
+type table struct {
+
+	// entries is the secrets file the table was built from, used to compare
+	// tables.
+	entries map[string]session.Credentials
+
+	exact    map[string]session.Credentials
+	cidrs    []rule
+	globs    []rule
+	fallback *session.Credentials
+}
+
+// newTable classifies each entry of a secrets file by its key.
+func newTable(entries map[string]session.Credentials) *table {
+	t := &table{
+		entries: entries,
+		exact:   map[string]session.Credentials{},
+	}
+	for key, creds := range entries {
+		if key == defaultKey {
+			creds := creds
+			t.fallback = &creds
+			continue
+		}
+		// every key is also a literal, so keys that happen to be valid
+		// patterns, e.g. [fe80::1]:623, still match themselves exactly
+		t.exact[key] = creds
+		switch {
+		case strings.Contains(key, "/"):
+			prefix, err := netip.ParsePrefix(key)
+			if err != nil {
+				continue
+			}
+			t.cidrs = append(t.cidrs, rule{
+				key:         key,
+				prefix:      prefix.Masked(),
+				credentials: creds,
+			})
+		case strings.ContainsAny(key, "*?["):
+			if _, err := path.Match(key, ""); err != nil {
+				continue
+			}
+			t.globs = append(t.globs, rule{
+				key:         key,
+				specificity: literals(key),
+				credentials: creds,
+			})
+		}
+	}
+	sort.Slice(t.cidrs, func(i, j int) bool {
+		a, b := t.cidrs[i], t.cidrs[j]
+		if a.prefix.Bits() != b.prefix.Bits() {
+			return a.prefix.Bits() > b.prefix.Bits()
+		}
+		return a.key < b.key
+	})
+	sort.Slice(t.globs, func(i, j int) bool {
+		a, b := t.globs[i], t.globs[j]
+		if a.specificity != b.specificity {
+			return a.specificity > b.specificity
+		}
+		return a.key < b.key
+	})
+	return t
+}
+
+// lookup returns the credentials for an addr, along with the kind and key of
+// the entry that matched. The key is empty for exact matches to avoid a metric
+// series per BMC. ok is false if no entry matched.
+func (t *table) lookup(addr string) (creds session.Credentials, kind, key string, ok bool) {
+	if creds, ok := t.exact[addr]; ok {
+		return creds, kindExact, "", true
+	}
+	host := hostOf(addr)
+	if len(t.cidrs) > 0 {
+		if ip, err := netip.ParseAddr(host); err == nil {
+			ip = ip.Unmap()
+			for _, r := range t.cidrs {
+				if r.prefix.Contains(ip) {
+					return r.credentials, kindCIDR, r.key, true
+				}
+			}
+		}
+	}
+	for _, r := range t.globs {
+		// try the whole addr first, so patterns can match on port
+		if matched, _ := path.Match(r.key, addr); matched {
+			return r.credentials, kindGlob, r.key, true
+		}
+		if matched, _ := path.Match(r.key, host); matched {
+			return r.credentials, kindGlob, r.key, true
+		}
+	}
+	if t.fallback != nil {
+		return *t.fallback, kindDefault, defaultKey, true
+	}
+	return session.Credentials{}, "", "", false
+}
+
+// Lookup implements session.Table.
+func (t *table) Lookup(addr string) (session.Credentials, bool) {
+	creds, _, _, ok := t.lookup(addr)
+	return creds, ok
+}
+
+// Equal implements session.Table, returning whether the tables were built from
+// equivalent secrets files.
+func (t *table) Equal(other *table) bool {
+	return len(session.ChangedAddrs(t.entries, other.entries)) == 0 &&
+		len(session.ChangedAddrs(other.entries, t.entries)) == 0
+}
+
+// hostOf strips any port and IPv6 brackets from an addr.
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// literals returns the number of characters in a glob pattern that are not
+// part of a wildcard or character class.
+func literals(pattern string) int {
+	n := 0
+	inClass := false
+	escaped := false
+	for _, c := range pattern {
+		switch {
+		case escaped:
+			escaped = false
+			if !inClass {
+				n++
+			}
+		case c == '\\':
+			escaped = true
+		case inClass:
+			if c == ']' {
+				inClass = false
+			}
+		case c == '[':
+			inClass = true
+		case c == '*', c == '?':
+		default:
+			n++
+		}
+	}
+	return n
+}
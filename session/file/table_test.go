@@ -0,0 +1,84 @@
+package file
+
+import (
+	"testing"
+
+	"github.com/gebn/bmc_exporter/session"
+)
+
+func TestTableLookup(t *testing.T) {
+	entries := map[string]session.Credentials{}
+	for _, key := range []string{
+		"10.0.0.1",
+		"10.0.0.1:624",
+		"[fe80::1]:623",
+		"fe80::2",
+		"10.0.0.0/8",
+		"10.20.0.0/16",
+		"10.20.30.0/24",
+		"2001:db8::/32",
+		"bmc-*.example.com",
+		"bmc-*.dc1.example.com",
+		"*.example.com:623",
+		"[ab]mc-?",
+		"not-a-cidr/x",
+		"default",
+	} {
+		entries[key] = session.Credentials{Username: key}
+	}
+	table := newTable(entries)
+
+	tests := []struct {
+		addr string
+		kind string
+		key  string
+	}{
+		{"10.0.0.1", kindExact, ""},
+		{"10.0.0.1:624", kindExact, ""},
+		{"[fe80::1]:623", kindExact, ""},
+		{"fe80::2", kindExact, ""},
+		{"not-a-cidr/x", kindExact, ""},
+		{"[ab]mc-?", kindExact, ""},
+		{"10.0.0.1:623", kindCIDR, "10.0.0.0/8"},
+		{"10.1.2.3", kindCIDR, "10.0.0.0/8"},
+		{"10.20.1.1", kindCIDR, "10.20.0.0/16"},
+		{"10.20.30.40:623", kindCIDR, "10.20.30.0/24"},
+		{"[2001:db8::1]:623", kindCIDR, "2001:db8::/32"},
+		{"::ffff:10.20.30.1", kindCIDR, "10.20.30.0/24"},
+		{"bmc-1.example.com", kindGlob, "bmc-*.example.com"},
+		{"bmc-1.dc1.example.com", kindGlob, "bmc-*.dc1.example.com"},
+		{"other.example.com:623", kindGlob, "*.example.com:623"},
+		{"amc-1", kindGlob, "[ab]mc-?"},
+		{"192.168.0.1", kindDefault, defaultKey},
+		{"other.example.org", kindDefault, defaultKey},
+	}
+	for _, test := range tests {
+		t.Run(test.addr, func(t *testing.T) {
+			creds, kind, key, ok := table.lookup(test.addr)
+			if !ok {
+				t.Fatalf("lookup(%q) found nothing", test.addr)
+			}
+			if kind != test.kind || key != test.key {
+				t.Errorf("lookup(%q) = %v %q, want %v %q", test.addr, kind,
+					key, test.kind, test.key)
+			}
+			want := test.key
+			if kind == kindExact {
+				want = test.addr
+			}
+			if creds.Username != want {
+				t.Errorf("lookup(%q) returned credentials of %q, want %q",
+					test.addr, creds.Username, want)
+			}
+		})
+	}
+}
+
+func TestTableLookupNoDefault(t *testing.T) {
+	table := newTable(map[string]session.Credentials{
+		"10.0.0.0/8": {Username: "a"},
+	})
+	if _, _, _, ok := table.lookup("192.168.0.1"); ok {
+		t.Error("lookup of unmatched addr succeeded without a default entry")
+	}
+}
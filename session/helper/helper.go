@@ -0,0 +1,187 @@
+// Package helper implements a credentials retriever that runs an external
+// program to obtain each BMC's credentials, in the style of git credential
+// helpers. This allows any secret store to be integrated with a short script.
+//
+// The helper is given the target addr either as its final argument or on
+// stdin, followed by a newline. It must exit 0 and print a JSON object
+// containing "username" and "password" keys to stdout. If it does not know
+// the target, it should exit 0 without printing anything. A non-zero exit
+// status is treated as a failure, and anything written to stderr is included
+// in the error.
+package helper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/gebn/bmc_exporter/session"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	namespace = "bmc"
+	subsystem = "provider"
+
+	invocations = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "helper_invocations_total",
+		Help:      "The number of times the credential helper has been run.",
+	})
+	failures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "helper_failures_total",
+		Help: "The number of credential helper invocations that failed to " +
+			"run, exited non-zero, timed out, or printed invalid output.",
+	})
+	duration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "helper_duration_seconds",
+		Help:      "Observes the time taken by each credential helper invocation.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 10), // 5.12
+	})
+)
+
+// maxStderr is the number of bytes of the helper's stderr to include in
+// errors.
+const maxStderr = 256
+
+// Config contains the parameters of a Provider. Only Command is required.
+type Config struct {
+
+	// Command is the path of the helper, followed by any arguments to pass
+	// before the addr.
+	Command []string
+
+	// Stdin indicates whether to pass the addr to the helper on stdin rather
+	// than as its final argument.
+	Stdin bool
+
+	// Timeout limits each invocation of the helper, in addition to the
+	// context passed to Credentials(). Defaults to 5 seconds.
+	Timeout time.Duration
+
+	// TTL is how long to cache the helper's output for each addr, including
+	// not knowing the addr. Zero disables caching, running the helper every
+	// time a session is required.
+	TTL time.Duration
+}
+
+// Provider implements session.CredentialsRetriever using a credential helper.
+// It also implements session.Provider via session.NewCredentialsProvider().
+type Provider struct {
+	session.Provider
+
+	config Config
+
+	// cache wraps run(), and is consulted by Credentials().
+	cache *session.CachingRetriever
+}
+
+// response is the output the helper is expected to print.
+type response struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+}
+
+// New validates the config and creates a Provider from it. It does not run the
+// helper.
+func New(c Config) (*Provider, error) {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return nil, errors.New("credential helper command must be specified")
+	}
+	if c.Timeout == 0 {
+		c.Timeout = time.Second * 5
+	}
+	p := &Provider{
+		config: c,
+	}
+	p.cache = session.NewCachingRetriever("helper",
+		session.RetrieverFunc(p.run), c.TTL, c.TTL)
+	p.Provider = session.NewCredentialsProvider(p)
+	return p, nil
+}
+
+// Reload discards all cached results, so the helper is run again for each addr
+// on next use. It never returns an error.
+func (p *Provider) Reload() error {
+	return p.cache.Reload()
+}
+
+// Invalidate implements session.Invalidator, discarding the cached output for
+// an addr, so the helper is run again next time.
+func (p *Provider) Invalidate(addr string) {
+	p.cache.Invalidate(addr)
+}
+
+// Credentials returns the credentials for the BMC at the supplied addr, running
+// the helper if there is no valid cache entry. Failures are not cached.
+func (p *Provider) Credentials(ctx context.Context, addr string) (*session.Credentials, error) {
+	return p.cache.Credentials(ctx, addr)
+}
+
+// run invokes the helper for an addr. It returns session.ErrCredentialNotFound
+// if the helper printed nothing.
+func (p *Provider) run(ctx context.Context, addr string) (*session.Credentials, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.config.Timeout)
+	defer cancel()
+
+	args := p.config.Command[1:]
+	if !p.config.Stdin {
+		args = append(args[:len(args):len(args)], addr)
+	}
+	cmd := exec.CommandContext(ctx, p.config.Command[0], args...)
+	if p.config.Stdin {
+		cmd.Stdin = strings.NewReader(addr + "\n")
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	invocations.Inc()
+	timer := prometheus.NewTimer(duration)
+	err := cmd.Run()
+	timer.ObserveDuration()
+	if err != nil {
+		failures.Inc()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("credential helper: %w", ctx.Err())
+		}
+		msg := strings.TrimSpace(stderr.String())
+		if len(msg) > maxStderr {
+			msg = msg[:maxStderr]
+		}
+		if msg == "" {
+			return nil, fmt.Errorf("credential helper: %w", err)
+		}
+		return nil, fmt.Errorf("credential helper: %w: %v", err, msg)
+	}
+
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, session.ErrCredentialNotFound
+	}
+	rsp := response{}
+	if err := json.Unmarshal(stdout.Bytes(), &rsp); err != nil {
+		failures.Inc()
+		return nil, fmt.Errorf("credential helper printed invalid JSON: %w", err)
+	}
+	if rsp.Username == nil || rsp.Password == nil {
+		failures.Inc()
+		return nil, errors.New("credential helper output is missing " +
+			"username or password")
+	}
+	return &session.Credentials{
+		Username: *rsp.Username,
+		Password: []byte(*rsp.Password),
+	}, nil
+}
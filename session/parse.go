@@ -0,0 +1,64 @@
+package session
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gebn/bmc/pkg/ipmi"
+)
+
+// cipherSuites contains the standard cipher suites whose algorithms are all
+// implemented by the bmc library, indexed by ID. Suites without an integrity
+// algorithm are omitted, as they would leave the session open to tampering.
+var cipherSuites = map[ipmi.CipherSuiteID]ipmi.CipherSuite{
+	2: {
+		AuthenticationAlgorithm:  ipmi.AuthenticationAlgorithmHMACSHA1,
+		IntegrityAlgorithm:       ipmi.IntegrityAlgorithmHMACSHA196,
+		ConfidentialityAlgorithm: ipmi.ConfidentialityAlgorithmNone,
+	},
+	3: ipmi.CipherSuite3,
+	7: {
+		AuthenticationAlgorithm:  ipmi.AuthenticationAlgorithmHMACMD5,
+		IntegrityAlgorithm:       ipmi.IntegrityAlgorithmHMACMD5128,
+		ConfidentialityAlgorithm: ipmi.ConfidentialityAlgorithmNone,
+	},
+	8: {
+		AuthenticationAlgorithm:  ipmi.AuthenticationAlgorithmHMACMD5,
+		IntegrityAlgorithm:       ipmi.IntegrityAlgorithmHMACMD5128,
+		ConfidentialityAlgorithm: ipmi.ConfidentialityAlgorithmAESCBC128,
+	},
+	16: {
+		AuthenticationAlgorithm:  ipmi.AuthenticationAlgorithmHMACSHA256,
+		IntegrityAlgorithm:       ipmi.IntegrityAlgorithmHMACSHA256128,
+		ConfidentialityAlgorithm: ipmi.ConfidentialityAlgorithmNone,
+	},
+	17: ipmi.CipherSuite17,
+}
+
+// CipherSuite returns the algorithms making up the cipher suite with the
+// provided ID, as listed in Table 22-20 of the IPMI v2.0 spec. An error is
+// returned if the suite is not supported.
+func CipherSuite(id ipmi.CipherSuiteID) (ipmi.CipherSuite, error) {
+	suite, ok := cipherSuites[id]
+	if !ok {
+		return ipmi.CipherSuite{}, fmt.Errorf("unsupported cipher suite %d", id)
+	}
+	return suite, nil
+}
+
+// ParsePrivilegeLevel converts the name of a privilege level, e.g. "operator",
+// into its value. It is case-insensitive. Only levels that make sense as a
+// session's maximum privilege level are accepted.
+func ParsePrivilegeLevel(s string) (ipmi.PrivilegeLevel, error) {
+	switch strings.ToLower(s) {
+	case "user":
+		return ipmi.PrivilegeLevelUser, nil
+	case "operator":
+		return ipmi.PrivilegeLevelOperator, nil
+	case "administrator", "admin":
+		return ipmi.PrivilegeLevelAdministrator, nil
+	default:
+		return 0, fmt.Errorf("invalid privilege level %q, must be one of "+
+			"user, operator or administrator", s)
+	}
+}
@@ -3,6 +3,7 @@ package session
 import (
 	"context"
 	"io"
+	"sync"
 
 	"github.com/gebn/bmc"
 )
@@ -62,3 +63,78 @@ type Provider interface {
 // Returning the io.Closer is messy, but there are not many ways around this,
 // short of giving the provider an already-open UDP socket, but then it would
 // not be able to create the session-less connection.
+
+// Reloader is implemented by providers whose config can be re-read without
+// restarting the exporter. The exporter calls this on SIGHUP and when /-/reload
+// is requested.
+type Reloader interface {
+
+	// Reload re-reads the provider's config. If an error is returned, the
+	// previous config must remain in effect.
+	Reload() error
+}
+
+// Invalidator is implemented by CredentialsRetrievers that cache credentials.
+// When every candidate credential for an addr has been rejected by the BMC,
+// the provider created by NewCredentialsProvider() calls Invalidate(), so the
+// next attempt fetches fresh credentials rather than repeating the failure
+// until the cache entry expires.
+type Invalidator interface {
+
+	// Invalidate discards any cached credentials for the addr.
+	Invalidate(addr string)
+}
+
+// ChangeNotifier is implemented by providers that know when the credentials
+// for an addr change, e.g. because they reload a config file. The exporter
+// uses this to close sessions established with credentials that are no longer
+// current, rather than continuing to use them until the session expires.
+type ChangeNotifier interface {
+
+	// OnChange registers a function to be called when credentials may have
+	// changed. It is passed a function reporting whether an addr's
+	// credentials have changed, been added or been removed, which the
+	// exporter applies to the targets it knows about. This saves providers
+	// whose entries match many addrs from having to remember every addr they
+	// have served. The reporting function must remain valid indefinitely. The
+	// registered function may be called from any goroutine, and should return
+	// quickly.
+	OnChange(func(changed func(addr string) bool))
+}
+
+// Notifier is a helper for implementing ChangeNotifier. The zero value is ready
+// to use.
+type Notifier struct {
+	mu  sync.Mutex
+	fns []func(changed func(addr string) bool)
+}
+
+// OnChange registers a function to be called by Notify().
+func (n *Notifier) OnChange(fn func(changed func(addr string) bool)) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.fns = append(n.fns, fn)
+}
+
+// Notify calls every registered function with the supplied function.
+func (n *Notifier) Notify(changed func(addr string) bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, fn := range n.fns {
+		fn(changed)
+	}
+}
+
+// ChangedAddrs returns the addrs in old whose credentials are either missing
+// from or different in new. It is intended for use by providers that reload
+// their config wholesale.
+func ChangedAddrs(old, new map[string]Credentials) []string {
+	changed := []string{}
+	for addr, oldCreds := range old {
+		newCreds, ok := new[addr]
+		if !ok || !oldCreds.Equal(&newCreds) {
+			changed = append(changed, addr)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,188 @@
+package session
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Table is an immutable set of credentials, loaded in its entirety from a
+// source such as a file. T is the implementing type.
+type Table[T any] interface {
+
+	// Lookup returns the credentials for an addr, and whether there were any.
+	Lookup(addr string) (Credentials, bool)
+
+	// Equal returns whether the table contains the same entries as another.
+	Equal(T) bool
+}
+
+// LoadFunc reads the latest version of a table from its source. It also
+// returns the version of the source it read, as returned by a VersionFunc.
+type LoadFunc[T any] func() (table T, version string, err error)
+
+// VersionFunc cheaply identifies the current version of a table's source, e.g.
+// its modification time, so it only needs to be loaded when this changes. An
+// empty version means the source must be loaded to tell whether it changed. An
+// error indicates the version is temporarily unknown, e.g. because the source
+// is being replaced.
+type VersionFunc func() (string, error)
+
+// ReloadMetrics are the gauges a ReloadableTable keeps up to date.
+type ReloadMetrics struct {
+
+	// LastReloadSuccessful is set to 1 after a successful load, and 0 after
+	// a failure.
+	LastReloadSuccessful prometheus.Gauge
+
+	// LastReloadSuccessTimestamp is set to the current time after each
+	// successful load.
+	LastReloadSuccessTimestamp prometheus.Gauge
+}
+
+// tableBox allows a table of any type to be stored in an atomic.Pointer.
+type tableBox[T any] struct {
+	table T
+}
+
+// ReloadableTable holds the current table of a provider whose credentials are
+// read wholesale from a source that can change, e.g. a file. Lookups use the
+// table as of when they started, and are lock-free. When a reload changes the
+// table, ChangeNotifier subscribers are told which addrs are affected. It is
+// intended to be embedded in providers, which then only have to implement
+// loading; it implements Reloader and ChangeNotifier.
+type ReloadableTable[T Table[T]] struct {
+
+	// name identifies the source in logs, e.g. its path.
+	name    string
+	load    LoadFunc[T]
+	version VersionFunc
+	metrics ReloadMetrics
+
+	notifier Notifier
+
+	// reloadMu serialises reloads, so each one compares against the table it
+	// is replacing.
+	reloadMu sync.Mutex
+
+	// current points to the current table, which is never modified once
+	// stored; a reload builds a new one and swaps the pointer.
+	current atomic.Pointer[tableBox[T]]
+
+	// seen is the version of the source as of the last reload attempt, used
+	// by Watch() to avoid reloading an unchanged source, or repeatedly
+	// failing to load the same broken one.
+	seen atomic.Pointer[string]
+}
+
+// NewReloadableTable loads a table for the first time, returning an error if
+// this fails.
+func NewReloadableTable[T Table[T]](name string, load LoadFunc[T], version VersionFunc, metrics ReloadMetrics) (*ReloadableTable[T], error) {
+	r := &ReloadableTable[T]{
+		name:    name,
+		load:    load,
+		version: version,
+		metrics: metrics,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Current returns the current table.
+func (r *ReloadableTable[T]) Current() T {
+	return r.current.Load().table
+}
+
+// OnChange implements ChangeNotifier. The function is called after each
+// reload that changes the table.
+func (r *ReloadableTable[T]) OnChange(fn func(changed func(addr string) bool)) {
+	r.notifier.OnChange(fn)
+}
+
+// Reload re-reads the source. If it cannot be read or is invalid, an error is
+// returned and the previous table remains in effect. This method is safe to
+// call concurrently with lookups and itself.
+func (r *ReloadableTable[T]) Reload() error {
+	_, err := r.reload()
+	return err
+}
+
+// reload implements Reload(), additionally returning whether the table
+// changed.
+func (r *ReloadableTable[T]) reload() (bool, error) {
+	r.reloadMu.Lock()
+	defer r.reloadMu.Unlock()
+
+	next, version, err := r.load()
+	if err != nil {
+		r.metrics.LastReloadSuccessful.Set(0)
+		return false, err
+	}
+	prev := r.current.Swap(&tableBox[T]{next})
+	r.seen.Store(&version)
+	r.metrics.LastReloadSuccessful.Set(1)
+	r.metrics.LastReloadSuccessTimestamp.SetToCurrentTime()
+	if prev == nil {
+		return true, nil
+	}
+	if prev.table.Equal(next) {
+		return false, nil
+	}
+	r.notifier.Notify(changed(prev.table, next))
+	return true, nil
+}
+
+// changed returns a function reporting whether an addr's credentials differ
+// between two tables, including if it only matches an entry in one of them.
+// As entries can match many addrs, this is evaluated for each target rather
+// than computed up-front.
+func changed[T Table[T]](prev, next T) func(addr string) bool {
+	return func(addr string) bool {
+		prevCreds, prevOK := prev.Lookup(addr)
+		nextCreds, ok := next.Lookup(addr)
+		if prevOK != ok {
+			return true
+		}
+		return ok && !prevCreds.Equal(&nextCreds)
+	}
+}
+
+// Watch checks the source's version every interval, reloading it if it
+// differs from the last reload attempt, or always if the version is empty.
+// Failures are logged rather than returned, as the previous table remains in
+// effect. This method blocks until the context is cancelled.
+func (r *ReloadableTable[T]) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			version, err := r.version()
+			if err != nil {
+				// source is probably mid-replacement; try again next tick
+				continue
+			}
+			if version != "" && version == *r.seen.Load() {
+				continue
+			}
+			changed, err := r.reload()
+			if err != nil {
+				log.Printf("failed to reload %v: %v", r.name, err)
+				// avoid logging the same failure every tick
+				r.seen.Store(&version)
+				continue
+			}
+			if changed {
+				log.Printf("reloaded %v", r.name)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
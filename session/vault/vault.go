@@ -0,0 +1,385 @@
+// Package vault implements a credentials retriever that reads BMC credentials
+// from HashiCorp Vault's KV v2 secrets engine. It speaks Vault's HTTP API
+// directly rather than depending on the official client, as only two
+// endpoints are required.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gebn/bmc_exporter/session"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	namespace = "bmc"
+	subsystem = "provider"
+
+	requests = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "vault_requests_total",
+			Help:      "The number of HTTP requests made to Vault, including retries.",
+		},
+		[]string{"operation"},
+	)
+	requestFailures = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystem,
+			Name:      "vault_request_failures_total",
+			Help: "The number of HTTP requests to Vault that did not " +
+				"produce a usable response. 404s are not failures.",
+		},
+		[]string{"operation"},
+	)
+
+	// errPermissionDenied is returned by the request helper when Vault
+	// responds with a 403. When using AppRole, this usually means our token
+	// has expired.
+	errPermissionDenied = errors.New("permission denied")
+)
+
+const (
+	operationRead  = "read"
+	operationLogin = "login"
+
+	// addrPlaceholder is replaced with the target addr in PathTemplate.
+	addrPlaceholder = "{addr}"
+
+	// staleTTL is how long after expiry cached credentials continue to be
+	// used if Vault cannot be reached to refresh them.
+	staleTTL = time.Hour
+)
+
+// Config contains the parameters of a Provider. Address, PathTemplate and
+// either Token or RoleID and SecretIDFile are required.
+type Config struct {
+
+	// Address is the base URL of the Vault server, e.g.
+	// https://vault.example.com:8200.
+	Address string
+
+	// Namespace is the Vault Enterprise namespace to use. Leave empty for the
+	// root namespace.
+	Namespace string
+
+	// Mount is the path of the KV v2 secrets engine. Defaults to "secret".
+	Mount string
+
+	// PathTemplate is the path of each BMC's secret within the mount, with
+	// "{addr}" standing in for the target addr, e.g. "bmc/{addr}". The addr is
+	// escaped as a single path segment.
+	PathTemplate string
+
+	// UsernameKey and PasswordKey are the keys in the secret holding the
+	// username and password. They default to "username" and "password".
+	UsernameKey string
+	PasswordKey string
+
+	// Token authenticates us to Vault. It is used as-is and never renewed, so
+	// should be long-lived or periodic. Mutually exclusive with RoleID.
+	Token string
+
+	// RoleID and the secret ID in SecretIDFile are used to log in via the
+	// AppRole auth method. The resulting token is renewed by logging in again
+	// when it nears expiry. The file is re-read on Reload().
+	RoleID       string
+	SecretIDFile string
+
+	// AppRoleMount is the path the AppRole auth method is mounted at.
+	// Defaults to "approle".
+	AppRoleMount string
+
+	// TTL is how long to cache credentials for when Vault does not return a
+	// lease duration, which is the case for KV v2. Defaults to 5 minutes.
+	TTL time.Duration
+
+	// Retries is the maximum number of times to retry a request that failed
+	// for a transient reason, e.g. a 5xx or network error. Zero disables
+	// retries.
+	Retries uint64
+
+	// Client is used to make requests. This can be used to set a timeout and
+	// TLS config. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// Provider implements session.CredentialsRetriever using Vault. It also
+// implements session.Provider via session.NewCredentialsProvider().
+type Provider struct {
+	session.Provider
+
+	config Config
+
+	// tokenMu protects token, tokenExpires and secretID. It is held while
+	// logging in to avoid a stampede when the token expires.
+	tokenMu      sync.Mutex
+	token        string
+	tokenExpires time.Time // zero if the token does not expire
+	secretID     string
+
+	// cache wraps read(), and is consulted by Credentials().
+	cache *session.CachingRetriever
+}
+
+// New validates the config and creates a Provider from it. It does not contact
+// Vault.
+func New(c Config) (*Provider, error) {
+	if c.Address == "" {
+		return nil, errors.New("vault address must be specified")
+	}
+	if !strings.Contains(c.PathTemplate, addrPlaceholder) {
+		return nil, fmt.Errorf("path template must contain %v", addrPlaceholder)
+	}
+	if (c.Token == "") == (c.RoleID == "") {
+		return nil, errors.New("exactly one of token or AppRole role ID " +
+			"must be specified")
+	}
+	if c.RoleID != "" && c.SecretIDFile == "" {
+		return nil, errors.New("AppRole secret ID file must be specified")
+	}
+	c.Address = strings.TrimSuffix(c.Address, "/")
+	if c.Mount == "" {
+		c.Mount = "secret"
+	}
+	if c.UsernameKey == "" {
+		c.UsernameKey = "username"
+	}
+	if c.PasswordKey == "" {
+		c.PasswordKey = "password"
+	}
+	if c.AppRoleMount == "" {
+		c.AppRoleMount = "approle"
+	}
+	if c.TTL == 0 {
+		c.TTL = time.Minute * 5
+	}
+	if c.Client == nil {
+		c.Client = http.DefaultClient
+	}
+	p := &Provider{
+		config: c,
+		token:  c.Token,
+	}
+	p.cache = session.NewCachingRetriever("vault", session.LeaseFunc(p.read),
+		c.TTL, 0)
+	p.cache.StaleTTL = staleTTL
+	if err := p.Reload(); err != nil {
+		return nil, err
+	}
+	p.Provider = session.NewCredentialsProvider(p)
+	return p, nil
+}
+
+// Credentials returns the username and password for the BMC at the supplied
+// addr, from the cache if a valid entry exists. If the entry has expired but
+// Vault cannot be reached, the expired credentials are returned for up to an
+// hour, as they are more likely to be correct than not.
+func (p *Provider) Credentials(ctx context.Context, addr string) (*session.Credentials, error) {
+	return p.cache.Credentials(ctx, addr)
+}
+
+// Reload re-reads the AppRole secret ID file, if any, and discards all cached
+// credentials, so they are re-read from Vault on next use. If the secret ID
+// file cannot be read, the previous secret ID continues to be used.
+func (p *Provider) Reload() error {
+	if p.config.SecretIDFile != "" {
+		b, err := os.ReadFile(p.config.SecretIDFile)
+		if err != nil {
+			return err
+		}
+		p.tokenMu.Lock()
+		p.secretID = strings.TrimSpace(string(b))
+		p.tokenMu.Unlock()
+	}
+	return p.cache.Reload()
+}
+
+// Invalidate implements session.Invalidator, discarding the cached credentials
+// for an addr after the BMC rejected them, so the secret is re-read from Vault
+// on next use. The stale copy is not kept, as it is known to be wrong.
+func (p *Provider) Invalidate(addr string) {
+	p.cache.Invalidate(addr)
+}
+
+// kvResponse is the subset of a KV v2 read response we care about.
+type kvResponse struct {
+	LeaseDuration int `json:"lease_duration"`
+	Data          struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+// read retrieves an addr's secret from Vault, returning the credentials it
+// contains and how long they may be cached for.
+func (p *Provider) read(ctx context.Context, addr string) (*session.Credentials, time.Duration, error) {
+	path := strings.ReplaceAll(p.config.PathTemplate, addrPlaceholder,
+		url.PathEscape(addr))
+	u := fmt.Sprintf("%v/v1/%v/data/%v", p.config.Address, p.config.Mount,
+		strings.TrimPrefix(path, "/"))
+
+	rsp := kvResponse{}
+	err := p.withToken(ctx, func(token string) error {
+		return p.do(ctx, operationRead, http.MethodGet, u, token, nil, &rsp)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	if rsp.Data.Data == nil {
+		// the latest version has been deleted but not destroyed
+		return nil, 0, session.ErrCredentialNotFound
+	}
+	username, ok := rsp.Data.Data[p.config.UsernameKey].(string)
+	if !ok {
+		return nil, 0, fmt.Errorf("secret is missing string key %v",
+			p.config.UsernameKey)
+	}
+	password, ok := rsp.Data.Data[p.config.PasswordKey].(string)
+	if !ok {
+		return nil, 0, fmt.Errorf("secret is missing string key %v",
+			p.config.PasswordKey)
+	}
+	ttl := p.config.TTL
+	if rsp.LeaseDuration > 0 {
+		ttl = time.Duration(rsp.LeaseDuration) * time.Second
+	}
+	return &session.Credentials{
+		Username: username,
+		Password: []byte(password),
+	}, ttl, nil
+}
+
+// withToken calls fn with a valid token, logging in first if necessary. If
+// using AppRole and fn fails with a permission error, we log in again and
+// retry once, as the token may have been revoked or expired early.
+func (p *Provider) withToken(ctx context.Context, fn func(token string) error) error {
+	token, err := p.currentToken(ctx, false)
+	if err != nil {
+		return err
+	}
+	err = fn(token)
+	if p.config.RoleID == "" || !errors.Is(err, errPermissionDenied) {
+		return err
+	}
+	if token, err = p.currentToken(ctx, true); err != nil {
+		return err
+	}
+	return fn(token)
+}
+
+// currentToken returns the token to use for requests, logging in via AppRole
+// if we do not have one, it is due to expire, or force is true.
+func (p *Provider) currentToken(ctx context.Context, force bool) (string, error) {
+	p.tokenMu.Lock()
+	defer p.tokenMu.Unlock()
+
+	if p.config.RoleID == "" {
+		return p.token, nil
+	}
+	if !force && p.token != "" && (p.tokenExpires.IsZero() ||
+		time.Now().Before(p.tokenExpires)) {
+		return p.token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"role_id":   p.config.RoleID,
+		"secret_id": p.secretID,
+	})
+	if err != nil {
+		return "", err
+	}
+	rsp := struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int    `json:"lease_duration"`
+		} `json:"auth"`
+	}{}
+	u := fmt.Sprintf("%v/v1/auth/%v/login", p.config.Address,
+		p.config.AppRoleMount)
+	if err := p.do(ctx, operationLogin, http.MethodPost, u, "", body, &rsp); err != nil {
+		// not %w, as a 404 here is a misconfigured mount rather than a
+		// missing credential
+		return "", fmt.Errorf("AppRole login failed: %v", err)
+	}
+	if rsp.Auth.ClientToken == "" {
+		return "", errors.New("AppRole login returned no token")
+	}
+	p.token = rsp.Auth.ClientToken
+	p.tokenExpires = time.Time{}
+	if rsp.Auth.LeaseDuration > 0 {
+		ttl := time.Duration(rsp.Auth.LeaseDuration) * time.Second
+		// log in again once a third of the TTL remains, to avoid racing with
+		// expiry
+		p.tokenExpires = time.Now().Add(ttl * 2 / 3)
+	}
+	return p.token, nil
+}
+
+// do sends a request to Vault, decoding the JSON response into dst. Network
+// errors, 429s and 5xxs are retried with exponential back-off. A 404 results
+// in session.ErrCredentialNotFound, and a 403 in errPermissionDenied.
+func (p *Provider) do(ctx context.Context, operation, method, u, token string, body []byte, dst interface{}) error {
+	attempt := func() error {
+		requests.WithLabelValues(operation).Inc()
+		var reader io.Reader
+		if body != nil {
+			reader = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, u, reader)
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		if token != "" {
+			req.Header.Set("X-Vault-Token", token)
+		}
+		if p.config.Namespace != "" {
+			req.Header.Set("X-Vault-Namespace", p.config.Namespace)
+		}
+		rsp, err := p.config.Client.Do(req)
+		if err != nil {
+			requestFailures.WithLabelValues(operation).Inc()
+			return err // likely transient
+		}
+		defer rsp.Body.Close()
+
+		switch {
+		case rsp.StatusCode == http.StatusNotFound:
+			return backoff.Permanent(session.ErrCredentialNotFound)
+		case rsp.StatusCode == http.StatusForbidden:
+			requestFailures.WithLabelValues(operation).Inc()
+			return backoff.Permanent(errPermissionDenied)
+		case rsp.StatusCode == http.StatusTooManyRequests ||
+			rsp.StatusCode >= 500:
+			requestFailures.WithLabelValues(operation).Inc()
+			return fmt.Errorf("unexpected status: %v", rsp.Status)
+		case rsp.StatusCode != http.StatusOK:
+			requestFailures.WithLabelValues(operation).Inc()
+			return backoff.Permanent(fmt.Errorf("unexpected status: %v",
+				rsp.Status))
+		}
+		if err := json.NewDecoder(rsp.Body).Decode(dst); err != nil {
+			requestFailures.WithLabelValues(operation).Inc()
+			return backoff.Permanent(fmt.Errorf("invalid response: %w", err))
+		}
+		return nil
+	}
+	return backoff.Retry(attempt, backoff.WithContext(
+		backoff.WithMaxRetries(backoff.NewExponentialBackOff(),
+			p.config.Retries), ctx))
+}
@@ -0,0 +1,399 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gebn/bmc_exporter/session"
+)
+
+// fakeVault is a minimal KV v2 and AppRole implementation. Secrets are keyed
+// by escaped request path, e.g. "/v1/secret/data/bmc/10.0.0.1".
+type fakeVault struct {
+	// token is the token required to read secrets.
+	token string
+
+	// roleID and secretID are accepted by the AppRole login endpoint, which
+	// responds with token.
+	roleID, secretID string
+
+	mu      sync.Mutex
+	secrets map[string]map[string]string
+
+	// failures is the number of reads to respond to with a 503 before
+	// serving them normally.
+	failures int
+
+	logins int32
+	reads  int32
+}
+
+func (f *fakeVault) setSecret(path string, data map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.secrets[path] = data
+}
+
+func (f *fakeVault) setToken(token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.token = token
+}
+
+func (f *fakeVault) setFailures(failures int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = failures
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if r.URL.Path == "/v1/auth/approle/login" {
+		atomic.AddInt32(&f.logins, 1)
+		body := map[string]string{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil ||
+			body["role_id"] != f.roleID || body["secret_id"] != f.secretID {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{
+				"client_token":   f.token,
+				"lease_duration": 3600,
+			},
+		})
+		return
+	}
+
+	atomic.AddInt32(&f.reads, 1)
+	if r.Header.Get("X-Vault-Token") != f.token {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	data, ok := f.secrets[r.URL.EscapedPath()]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"lease_duration": 0,
+		"data": map[string]interface{}{
+			"data": data,
+		},
+	})
+}
+
+func newFakeVault(t *testing.T) (*fakeVault, *httptest.Server) {
+	f := &fakeVault{
+		token:    "s.token",
+		roleID:   "role",
+		secretID: "secret",
+		secrets:  map[string]map[string]string{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+// writeSecretID writes an AppRole secret ID to path, or a new file in a
+// temporary directory if path is empty, returning the path written.
+func writeSecretID(t *testing.T, path, secretID string) string {
+	t.Helper()
+	if path == "" {
+		path = filepath.Join(t.TempDir(), "secret-id")
+	}
+	if err := os.WriteFile(path, []byte(secretID+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustCredentials(t *testing.T, p *Provider, addr string) *session.Credentials {
+	t.Helper()
+	creds, err := p.Credentials(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("Credentials(%q) returned error: %v", addr, err)
+	}
+	return creds
+}
+
+func TestTokenAuth(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.setSecret("/v1/secret/data/bmc/10.0.0.1", map[string]string{
+		"username": "admin",
+		"password": "hunter2",
+	})
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		Token:        f.token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := mustCredentials(t, p, "10.0.0.1")
+	if creds.Username != "admin" || string(creds.Password) != "hunter2" {
+		t.Errorf("got %v/%s, want admin/hunter2", creds.Username,
+			creds.Password)
+	}
+	if logins := atomic.LoadInt32(&f.logins); logins != 0 {
+		t.Errorf("token auth logged in %v times, want 0", logins)
+	}
+}
+
+func TestAppRoleAuth(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.setSecret("/v1/secret/data/bmc/10.0.0.1", map[string]string{
+		"username": "admin",
+		"password": "hunter2",
+	})
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		RoleID:       f.roleID,
+		SecretIDFile: writeSecretID(t, "", f.secretID),
+		TTL:          time.Nanosecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustCredentials(t, p, "10.0.0.1")
+	mustCredentials(t, p, "10.0.0.1")
+	if logins := atomic.LoadInt32(&f.logins); logins != 1 {
+		t.Errorf("logged in %v times, want 1, as the token is still valid",
+			logins)
+	}
+
+	// simulate the token being revoked; the provider should log in again
+	f.setToken("s.rotated")
+	mustCredentials(t, p, "10.0.0.1")
+	if logins := atomic.LoadInt32(&f.logins); logins != 2 {
+		t.Errorf("logged in %v times after revocation, want 2", logins)
+	}
+}
+
+func TestAppRoleLoginRejected(t *testing.T) {
+	f, srv := newFakeVault(t)
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		RoleID:       f.roleID,
+		SecretIDFile: writeSecretID(t, "", "wrong"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Credentials(context.Background(), "10.0.0.1")
+	if err == nil || errors.Is(err, session.ErrCredentialNotFound) {
+		t.Errorf("got error %v, want a login failure", err)
+	}
+}
+
+func TestAppRoleSecretIDReload(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.setSecret("/v1/secret/data/bmc/10.0.0.1", map[string]string{
+		"username": "admin",
+		"password": "hunter2",
+	})
+	path := writeSecretID(t, "", "old")
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		RoleID:       f.roleID,
+		SecretIDFile: path,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = p.Credentials(context.Background(), "10.0.0.1"); err == nil {
+		t.Fatal("got no error with the old secret ID, want a login failure")
+	}
+
+	writeSecretID(t, path, f.secretID)
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	mustCredentials(t, p, "10.0.0.1")
+
+	// an unreadable file keeps the current secret ID
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Reload(); err == nil {
+		t.Error("Reload() succeeded with the secret ID file missing")
+	}
+	p.Invalidate("10.0.0.1")
+	f.setToken("s.rotated")
+	mustCredentials(t, p, "10.0.0.1")
+	if logins := atomic.LoadInt32(&f.logins); logins != 3 {
+		t.Errorf("logged in %v times, want 3", logins)
+	}
+}
+
+func TestAppRoleSecretIDFileMissing(t *testing.T) {
+	_, err := New(Config{
+		Address:      "http://127.0.0.1:8200",
+		PathTemplate: "bmc/{addr}",
+		RoleID:       "role",
+		SecretIDFile: filepath.Join(t.TempDir(), "missing"),
+	})
+	if err == nil {
+		t.Error("New() succeeded with a missing secret ID file")
+	}
+}
+
+func TestPathTemplate(t *testing.T) {
+	f, srv := newFakeVault(t)
+	// the addr is escaped as a single path segment
+	f.setSecret("/v1/kv/data/dc1/bmc%2Fa/ipmi", map[string]string{
+		"user": "root",
+		"pass": "calvin",
+	})
+	p, err := New(Config{
+		Address:      srv.URL + "/",
+		Mount:        "kv",
+		PathTemplate: "/dc1/{addr}/ipmi",
+		UsernameKey:  "user",
+		PasswordKey:  "pass",
+		Token:        f.token,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds := mustCredentials(t, p, "bmc/a")
+	if creds.Username != "root" || string(creds.Password) != "calvin" {
+		t.Errorf("got %v/%s, want root/calvin", creds.Username,
+			creds.Password)
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	f, srv := newFakeVault(t)
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		Token:        f.token,
+		Retries:      3,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = p.Credentials(context.Background(), "10.0.0.1")
+	if !errors.Is(err, session.ErrCredentialNotFound) {
+		t.Errorf("got error %v, want %v", err, session.ErrCredentialNotFound)
+	}
+	if reads := atomic.LoadInt32(&f.reads); reads != 1 {
+		t.Errorf("read %v times, want 1, as 404s are not retried", reads)
+	}
+}
+
+func TestServerErrorRetry(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.setSecret("/v1/secret/data/bmc/10.0.0.1", map[string]string{
+		"username": "admin",
+		"password": "hunter2",
+	})
+	f.setFailures(2)
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		Token:        f.token,
+		Retries:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustCredentials(t, p, "10.0.0.1")
+	if reads := atomic.LoadInt32(&f.reads); reads != 3 {
+		t.Errorf("read %v times, want 3", reads)
+	}
+
+	// with retries exhausted, the error is returned
+	f.setFailures(2)
+	p.Reload()
+	p.config.Retries = 1
+	_, err = p.Credentials(context.Background(), "10.0.0.1")
+	if err == nil || errors.Is(err, session.ErrCredentialNotFound) {
+		t.Errorf("got error %v, want a server error", err)
+	}
+
+	// zero disables retries
+	f.setFailures(1)
+	p.config.Retries = 0
+	before := atomic.LoadInt32(&f.reads)
+	if _, err = p.Credentials(context.Background(), "10.0.0.1"); err == nil {
+		t.Error("got no error with retries disabled, want a server error")
+	}
+	if reads := atomic.LoadInt32(&f.reads) - before; reads != 1 {
+		t.Errorf("read %v times with retries disabled, want 1", reads)
+	}
+}
+
+func TestCacheRefresh(t *testing.T) {
+	f, srv := newFakeVault(t)
+	f.setSecret("/v1/secret/data/bmc/10.0.0.1", map[string]string{
+		"username": "admin",
+		"password": "old",
+	})
+	ttl := time.Millisecond * 100
+	p, err := New(Config{
+		Address:      srv.URL,
+		PathTemplate: "bmc/{addr}",
+		Token:        f.token,
+		TTL:          ttl,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mustCredentials(t, p, "10.0.0.1")
+	f.setSecret("/v1/secret/data/bmc/10.0.0.1", map[string]string{
+		"username": "admin",
+		"password": "new",
+	})
+	if creds := mustCredentials(t, p, "10.0.0.1"); string(creds.Password) != "old" {
+		t.Errorf("got password %s within TTL, want cached old", creds.Password)
+	}
+	if reads := atomic.LoadInt32(&f.reads); reads != 1 {
+		t.Errorf("read %v times within TTL, want 1", reads)
+	}
+
+	time.Sleep(ttl)
+	if creds := mustCredentials(t, p, "10.0.0.1"); string(creds.Password) != "new" {
+		t.Errorf("got password %s after TTL, want new", creds.Password)
+	}
+
+	// once expired, the stale entry is served if Vault is unavailable
+	time.Sleep(ttl)
+	srv.Close()
+	if creds := mustCredentials(t, p, "10.0.0.1"); string(creds.Password) != "new" {
+		t.Errorf("got password %s with Vault down, want stale new",
+			creds.Password)
+	}
+
+	// but not once the BMC has rejected it
+	p.Invalidate("10.0.0.1")
+	if _, err := p.Credentials(context.Background(), "10.0.0.1"); err == nil {
+		t.Error("got no error with Vault down after invalidation")
+	}
+}